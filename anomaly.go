@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+var anomalyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "anomaly-state-file",
+		Usage: "Keep rolling baselines in this file and score each result against them, disabled when empty",
+	},
+	cli.Float64Flag{
+		Name:  "anomaly-sensitivity",
+		Value: 3.5,
+		Usage: "The anomaly_score at which a result is an anomaly, in robust standard deviations",
+	},
+	cli.IntFlag{
+		Name:  "anomaly-window",
+		Value: 30,
+		Usage: "The number of results each baseline keeps",
+	},
+	cli.IntFlag{
+		Name:  "anomaly-min-samples",
+		Value: 5,
+		Usage: "The number of results a baseline needs before results are scored against it",
+	},
+}
+
+// baseline is the recent values of one server at one hour of the day
+type baseline struct {
+	Latency  []float64 `json:"latency"`
+	Download []float64 `json:"download"`
+	Upload   []float64 `json:"upload"`
+}
+
+// anomalyState is what's persisted between runs, including which metrics of
+// which servers are currently anomalous so a restart doesn't re-alert
+type anomalyState struct {
+	Baselines map[string]*baseline `json:"baselines"`
+	Anomalous map[string]bool      `json:"anomalous,omitempty"`
+}
+
+// anomalyDetector scores results by how far they are from the median of
+// their baseline, scaled by the median absolute deviation
+type anomalyDetector struct {
+	path        string
+	sensitivity float64
+	window      int
+	minSamples  int
+
+	state anomalyState
+}
+
+func newAnomalyDetector(c *cli.Context) (*anomalyDetector, error) {
+	if c.String("anomaly-state-file") == "" {
+		return nil, nil
+	}
+
+	d := &anomalyDetector{
+		path:        c.String("anomaly-state-file"),
+		sensitivity: c.Float64("anomaly-sensitivity"),
+		window:      c.Int("anomaly-window"),
+		minSamples:  c.Int("anomaly-min-samples"),
+	}
+	if d.minSamples < 3 {
+		d.minSamples = 3
+	}
+	if d.window < d.minSamples {
+		return nil, fmt.Errorf("--anomaly-window must be at least --anomaly-min-samples")
+	}
+
+	var err error
+	d.state, err = loadAnomalyState(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// loadAnomalyState reads the saved baselines, starting afresh if there are
+// none yet
+func loadAnomalyState(path string) (anomalyState, error) {
+	state := anomalyState{Baselines: map[string]*baseline{}, Anomalous: map[string]bool{}}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, fmt.Errorf("error reading anomaly state: %v", err)
+	}
+
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return state, fmt.Errorf("error decoding anomaly state %s: %v", path, err)
+	}
+	if state.Baselines == nil {
+		state.Baselines = map[string]*baseline{}
+	}
+	if state.Anomalous == nil {
+		state.Anomalous = map[string]bool{}
+	}
+	// latches used to be kept per hour of the day as well, which re-alerted
+	// every hour
+	for key := range state.Anomalous {
+		if strings.Count(key, "/") != 1 {
+			delete(state.Anomalous, key)
+		}
+	}
+
+	return state, nil
+}
+
+// anomalyMetric is one of the values a baseline tracks, and which way is bad
+type anomalyMetric struct {
+	name   string
+	value  func(res results) *float64
+	values func(b *baseline) *[]float64
+	higher bool
+}
+
+var anomalyMetrics = []anomalyMetric{
+	{"download", func(res results) *float64 { return res.download }, func(b *baseline) *[]float64 { return &b.Download }, false},
+	{"upload", func(res results) *float64 { return res.upload }, func(b *baseline) *[]float64 { return &b.Upload }, false},
+	{"latency", func(res results) *float64 { return res.latency }, func(b *baseline) *[]float64 { return &b.Latency }, true},
+}
+
+// observe scores the result against its baseline and then adds it,
+// returning the worst score and an event for each metric whose score first
+// crosses the sensitivity. Results without a server or without enough
+// history aren't scored.
+func (d *anomalyDetector) observe(res results) (*float64, []event) {
+	if res.server.ID == "" {
+		return nil, nil
+	}
+
+	key := fmt.Sprintf("%s/%02d", res.server.ID, res.timestamp.Hour())
+	b, ok := d.state.Baselines[key]
+	if !ok {
+		b = &baseline{}
+		d.state.Baselines[key] = b
+	}
+
+	var score *float64
+	var events []event
+	for _, m := range anomalyMetrics {
+		v := m.value(res)
+		if v == nil {
+			continue
+		}
+
+		values := m.values(b)
+		if s, median, ok := robustScore(*values, *v, m.higher, d.minSamples); ok {
+			if score == nil || s > *score {
+				score = &s
+			}
+			if ev := d.latch(m, s, median, res); ev != nil {
+				events = append(events, *ev)
+			}
+		}
+
+		*values = append(*values, *v)
+		if len(*values) > d.window {
+			*values = (*values)[len(*values)-d.window:]
+		}
+	}
+
+	err := d.save()
+	if err != nil {
+		log.Printf("error saving anomaly state: %v", err)
+	}
+
+	return score, events
+}
+
+// latch records whether a metric of a server is anomalous, returning an
+// event only when it wasn't already. It's kept across the hourly baselines,
+// so a problem that lasts hours alerts once.
+func (d *anomalyDetector) latch(m anomalyMetric, score float64, median float64, res results) *event {
+	latchKey := res.server.ID + "/" + m.name
+	if score < d.sensitivity {
+		delete(d.state.Anomalous, latchKey)
+		return nil
+	}
+	if d.state.Anomalous[latchKey] {
+		return nil
+	}
+	d.state.Anomalous[latchKey] = true
+
+	log.Printf("anomalous %s from server %s, score %.2f", m.name, res.server.ID, score)
+	return &event{
+		name: "speedtest_anomaly",
+		tags: map[string]string{
+			"server_id": res.server.ID,
+			"metric":    m.name,
+		},
+		fields: map[string]interface{}{
+			"anomaly_score": score,
+			"value":         *m.value(res),
+			"baseline":      median,
+		},
+		at: res.timestamp,
+	}
+}
+
+// robustScore is how many robust standard deviations v is from the median
+// of values in the bad direction, never negative. The scale is at least 5%
+// of the median so a very steady link doesn't flag noise.
+func robustScore(values []float64, v float64, higherIsWorse bool, minSamples int) (float64, float64, bool) {
+	if len(values) < minSamples {
+		return 0, 0, false
+	}
+
+	med := median(values)
+	deviations := make([]float64, len(values))
+	for i, x := range values {
+		deviations[i] = math.Abs(x - med)
+	}
+
+	// 1.4826 scales the MAD to the standard deviation of a normal distribution
+	scale := math.Max(1.4826*median(deviations), 0.05*math.Abs(med))
+	if scale == 0 {
+		return 0, med, false
+	}
+
+	score := (med - v) / scale
+	if higherIsWorse {
+		score = -score
+	}
+
+	return math.Max(score, 0), med, true
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// save writes the state to disk
+func (d *anomalyDetector) save() error {
+	b, err := json.Marshal(d.state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(d.path, b)
+}
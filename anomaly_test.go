@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_robustScore(t *testing.T) {
+	values := []float64{90, 92, 94, 96, 98}
+	tests := []struct {
+		name          string
+		values        []float64
+		v             float64
+		higherIsWorse bool
+		want          float64
+		wantOK        bool
+	}{
+		{"too few samples", values[:4], 10, false, 0, false},
+		{"at the median", values, 94, false, 0, true},
+		{"better than usual", values, 120, false, 0, true},
+		{"slow download", values, 47, false, 10, true},
+		{"high latency", []float64{10, 10, 10, 10, 10}, 12, true, 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, ok := robustScore(tt.values, tt.v, tt.higherIsWorse, 5)
+			if ok != tt.wantOK || (got-tt.want) > 1e-9 || (tt.want-got) > 1e-9 {
+				t.Errorf("robustScore() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_anomalyDetector_observe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anomaly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &anomalyDetector{
+		path:        filepath.Join(dir, "state.json"),
+		sensitivity: 3.5,
+		window:      30,
+		minSamples:  5,
+		state:       anomalyState{Baselines: map[string]*baseline{}, Anomalous: map[string]bool{}},
+	}
+
+	at := time.Date(2018, 5, 1, 13, 20, 0, 0, time.UTC)
+	observe := func(latency float64, download float64) (*float64, []event) {
+		at = at.AddDate(0, 0, 1)
+		return d.observe(results{server: testServer, latency: &latency, download: &download, timestamp: at})
+	}
+
+	for _, v := range []float64{90, 92, 94, 96, 98} {
+		if score, evs := observe(9.5, v); score != nil || evs != nil {
+			t.Fatalf("observe() while building the baseline = %v, %+v, want no score or events", score, evs)
+		}
+	}
+
+	score, evs := observe(9.5, 40)
+	if score == nil || *score < 3.5 || len(evs) != 1 {
+		t.Fatalf("observe() of a slow download = %v, %+v, want one anomaly event", score, evs)
+	}
+	wantTags := map[string]string{"server_id": "1234", "metric": "download"}
+	if !reflect.DeepEqual(evs[0].tags, wantTags) || evs[0].fields["baseline"] != 94.0 {
+		t.Errorf("anomaly event = %+v, want download against a baseline of 94", evs[0])
+	}
+
+	if _, evs = observe(9.5, 40); evs != nil {
+		t.Errorf("observe() of a second slow download = %+v, want no event until it recovers", evs)
+	}
+
+	// a latency anomaly on the same server isn't hidden by the download one
+	if _, evs = observe(80, 40); len(evs) != 1 || evs[0].tags["metric"] != "latency" {
+		t.Errorf("observe() of high latency = %+v, want a latency anomaly event", evs)
+	}
+
+	// the latch survives a restart
+	restarted := *d
+	if restarted.state, err = loadAnomalyState(d.path); err != nil {
+		t.Fatalf("loadAnomalyState() error = %v", err)
+	}
+	if _, evs = restarted.observe(results{server: testServer, latency: floatPtr(80), download: floatPtr(40), timestamp: at.AddDate(0, 0, 1)}); evs != nil {
+		t.Errorf("observe() after a restart = %+v, want no repeated events", evs)
+	}
+
+	// a different hour of the day has its own baseline
+	if score, _ := d.observe(results{server: testServer, download: floatPtr(40), timestamp: at.Add(time.Hour)}); score != nil {
+		t.Errorf("observe() in a new hour = %v, want no score", *score)
+	}
+
+	// but the latch doesn't, a slow download that lasts into the next hour
+	// isn't alerted again
+	d.state.Baselines[fmt.Sprintf("%s/%02d", testServer.ID, at.Add(time.Hour).Hour())].Download = []float64{40, 90, 92, 94, 96, 98}
+	if score, evs := d.observe(results{server: testServer, download: floatPtr(40), timestamp: at.Add(time.Hour)}); score == nil || *score < 3.5 || evs != nil {
+		t.Errorf("observe() of a slow download in the next hour = %v, %+v, want a score but no event", score, evs)
+	}
+	if len(d.state.Anomalous) != 2 {
+		t.Errorf("anomalous = %v, want a latch per metric", d.state.Anomalous)
+	}
+
+	saved, err := loadAnomalyState(d.path)
+	if err != nil {
+		t.Fatalf("loadAnomalyState() error = %v", err)
+	}
+	if !reflect.DeepEqual(saved, d.state) {
+		t.Errorf("loadAnomalyState() = %+v, want the saved %+v", saved, d.state)
+	}
+}
+
+func Test_loadAnomalyState_hourlyLatches(t *testing.T) {
+	f, err := ioutil.TempFile("", "anomaly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"baselines": {}, "anomalous": {"1234/13/download": true, "1234/latency": true}}`)
+	f.Close()
+
+	state, err := loadAnomalyState(f.Name())
+	if err != nil {
+		t.Fatalf("loadAnomalyState() error = %v", err)
+	}
+	if want := map[string]bool{"1234/latency": true}; !reflect.DeepEqual(state.Anomalous, want) {
+		t.Errorf("anomalous = %v, want the hourly latch dropped", state.Anomalous)
+	}
+}
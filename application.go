@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/influxdata/influxdb/client/v2"
@@ -15,11 +17,45 @@ import (
 // Version placeholder, injected in Makefile
 var Version string
 
+// result statuses, written as the status tag
+const (
+	statusOK      = "ok"
+	statusPartial = "partial"
+	statusFailed  = "failed"
+)
+
+// test phases, written as the failed_phase tag
+const (
+	phaseConfig   = "config"
+	phaseServer   = "server"
+	phaseDownload = "download"
+	phaseUpload   = "upload"
+)
+
 type results struct {
-	server   http.Server
-	latency  *float64
-	download *float64
-	upload   *float64
+	server      http.Server
+	client      http.Config
+	plan        plan
+	latency     *float64
+	download    *float64
+	upload      *float64
+	failedPhase string
+	err         error
+	timestamp   time.Time
+	duration    time.Duration
+	anomaly     *float64
+}
+
+// status reports whether the cycle produced all, some or none of its values
+func (res results) status() string {
+	switch {
+	case res.latency != nil && res.download != nil && res.upload != nil:
+		return statusOK
+	case res.latency != nil || res.download != nil || res.upload != nil:
+		return statusPartial
+	default:
+		return statusFailed
+	}
 }
 
 func main() {
@@ -41,58 +77,137 @@ func main() {
 			Name:  "server, s",
 			Usage: "Use a specific server",
 		},
-		cli.StringFlag{
-			Name:  "influxUsername, u",
-			Usage: "The username for the influxDB instance",
-		},
-		cli.StringFlag{
-			Name:  "influxPasword, p",
-			Usage: "The password for the influxDB instance",
-		},
-		cli.StringFlag{
-			Name:  "influxDB, db",
-			Usage: "The name for the influxDB database",
-		},
-		cli.StringFlag{
-			Name:  "influxURL, url",
-			Value: "http://localhost:8086",
-			Usage: "The name for the influxDB database",
-		},
 		cli.IntFlag{
 			Name:  "interval, i",
 			Value: 20,
 			Usage: "The amount of time in minutes to wait between speedtest runs",
 		},
+		cli.IntFlag{
+			Name:  "outage-threshold",
+			Value: 2,
+			Usage: "The number of consecutive connectivity failures that start an outage",
+		},
+		cli.IntFlag{
+			Name:  "outage-probe-interval",
+			Value: 30,
+			Usage: "The amount of time in seconds to wait between reachability probes during an outage",
+		},
+		cli.StringFlag{
+			Name:  "outage-state-file",
+			Usage: "Keep the cumulative downtime in this file so it survives restarts, when empty it counts from process start",
+		},
+	}
+	app.Flags = append(app.Flags, influxFlags...)
+	app.Flags = append(app.Flags, prometheusFlags...)
+	app.Flags = append(app.Flags, remoteWriteFlags...)
+	app.Flags = append(app.Flags, graphiteFlags...)
+	app.Flags = append(app.Flags, statsdFlags...)
+	app.Flags = append(app.Flags, mqttFlags...)
+	app.Flags = append(app.Flags, otlpFlags...)
+	app.Flags = append(app.Flags, historyFlags...)
+	app.Flags = append(app.Flags, fileFlags...)
+	app.Flags = append(app.Flags, webhookFlags...)
+	app.Flags = append(app.Flags, postgresFlags...)
+	app.Flags = append(app.Flags, elasticsearchFlags...)
+	app.Flags = append(app.Flags, lokiFlags...)
+	app.Flags = append(app.Flags, notifyFlags...)
+	app.Flags = append(app.Flags, emailFlags...)
+	app.Flags = append(app.Flags, ruleFlags...)
+	app.Flags = append(app.Flags, planFlags...)
+	app.Flags = append(app.Flags, anomalyFlags...)
+
+	app.Commands = []cli.Command{
+		exportCommand,
+		reportCommand,
 	}
 
 	// toggle our switches and setup variables
-	app.Action = func(c *cli.Context) {
-		db, err := influxDBClient(c.String("influxURL"), c.String("influxUsername"), c.String("influxPassword"))
+	app.Action = func(c *cli.Context) error {
+		// keep the log lines out of results piped to stdout
+		if c.String("file-path") == "-" {
+			log.SetOutput(os.Stderr)
+		}
+
+		rules, err := parseRules(c.StringSlice("alert-rule"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		alerts := newRuleEngine(rules)
+		contract := planFromFlags(c)
+
+		anomalies, err := newAnomalyDetector(c)
 		if err != nil {
-			log.Printf("error connecting to influxdb: %v", err)
+			return cli.NewExitError(err.Error(), 1)
 		}
 
-		speedtestClient, err := speedtest.NewDefaultClient()
+		sinks, err := newSinks(c)
 		if err != nil {
-			log.Printf("couldn't create speedtest client: %v", err)
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer sinks.close()
+
+		var speedtestClient *speedtest.Client
+		outages, err := newOutageDetector(c.Int("outage-threshold"), c.String("outage-state-file"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
 		}
 
 		// Run speedtest indefinitely
 		for {
-			res, err := runSpeedtest(c, speedtestClient)
-			if err != nil {
-				log.Printf("error running speedtest: %v", err)
+			// during an outage only probe reachability until it recovers
+			if outages.active {
+				speedtestClient, err = probeConnectivity(c, speedtestClient)
+				if err != nil {
+					log.Printf("outage ongoing, reachability probe failed: %v", err)
+					<-time.After(time.Duration(c.Int("outage-probe-interval")) * time.Second)
+					continue
+				}
+
+				recordOutage(sinks, outages.record(false, time.Now()))
+			}
+
+			var res results
+			start := time.Now()
+
+			// the client fetches the speedtest config when created, so retry
+			// it every cycle until it succeeds
+			if speedtestClient == nil {
+				speedtestClient, err = newSpeedtestClient()
+				if err != nil {
+					log.Printf("couldn't create speedtest client: %v", err)
+					res = results{failedPhase: phaseConfig, err: err}
+				}
 			}
 
-			if res.latency != nil && res.upload != nil && res.download != nil {
-				err := writeMetrics(db, c.String("influxDB"), res)
+			if speedtestClient != nil {
+				res, err = runSpeedtest(c, speedtestClient)
 				if err != nil {
-					log.Printf("error writing to influxdb: %v", err)
+					log.Printf("error running speedtest: %v", err)
 				}
+			}
+
+			res.timestamp = time.Now()
+			res.duration = res.timestamp.Sub(start)
+			res.plan = contract
+
+			var anomalyEvents []event
+			if anomalies != nil {
+				res.anomaly, anomalyEvents = anomalies.observe(res)
+			}
+
+			log.Printf("writing %s speedtest results %s", res.status(), res)
+			sinks.writeResult(res)
+			for _, ev := range anomalyEvents {
+				sinks.writeEvent(ev)
+			}
+			for _, ev := range alerts.evaluate(res) {
+				sinks.writeEvent(ev)
+			}
 
-				log.Printf("writing speedtest results {server: %s, ping: %3.2fms, download: %3.2fMbps, upload: %3.2fMbps} to influxdb", res.server.Sponsor, *res.latency, *res.download, *res.upload)
-			} else {
-				log.Printf("speedtest results have no values, skipping writing to influxdb")
+			recordOutage(sinks, outages.record(connectivityFailure(res), time.Now()))
+			if outages.active {
+				<-time.After(time.Duration(c.Int("outage-probe-interval")) * time.Second)
+				continue
 			}
 
 			<-time.After(time.Duration(c.Int("interval")) * time.Minute)
@@ -105,28 +220,107 @@ func main() {
 	}
 }
 
+func newSpeedtestClient() (*speedtest.Client, error) {
+	client, err := speedtest.NewDefaultClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// runSpeedtest returns whatever values were measured before an error, with
+// the phase that failed recorded on the results
 func runSpeedtest(c *cli.Context, client *speedtest.Client) (results, error) {
+	var res results
+	if client.HTTPClient != nil && client.HTTPClient.Config != nil {
+		res.client = *client.HTTPClient.Config
+	}
+
 	server, err := client.GetServer(c.String("server"))
 	if err != nil {
-		return results{}, err
+		res.failedPhase, res.err = phaseServer, err
+		return res, err
 	}
+	res.latency, res.server = &server.Latency, server
 
 	dmbps, err := client.Download(server)
 	if err != nil {
-		return results{}, err
+		res.failedPhase, res.err = phaseDownload, err
+		return res, err
 	}
+	res.download = &dmbps
 
 	umbps, err := client.Upload(server)
 	if err != nil {
-		return results{}, err
+		res.failedPhase, res.err = phaseUpload, err
+		return res, err
+	}
+	res.upload = &umbps
+
+	return res, nil
+}
+
+// recordOutage logs and writes an outage event, if there is one
+func recordOutage(sinks *fanout, ev *outageEvent) {
+	if ev == nil {
+		return
+	}
+
+	if ev.kind == outageStart {
+		log.Printf("outage started at %s", ev.start.Format(time.RFC3339))
+	} else {
+		log.Printf("outage ended after %s, total downtime %s", ev.duration(), ev.downtime)
+	}
+
+	sinks.writeEvent(ev.event())
+}
+
+// writeStats writes a point of internal counters, failures are only logged
+func writeStats(c client.Client, database string, rp string, measurement string, fields map[string]interface{}) {
+	bp, err := client.NewBatchPoints(
+		client.BatchPointsConfig{
+			Database:        database,
+			RetentionPolicy: rp,
+			Precision:       "s",
+		},
+	)
+	if err != nil {
+		log.Printf("error creating %s batch: %v", measurement, err)
+		return
+	}
+
+	point, err := client.NewPoint(measurement, nil, fields, time.Now())
+	if err != nil {
+		log.Printf("error creating %s point: %v", measurement, err)
+		return
+	}
+
+	bp.AddPoint(point)
+
+	err = c.Write(bp)
+	if err != nil {
+		log.Printf("error writing %s to influxdb: %v", measurement, err)
 	}
+}
 
-	return results{
-		latency:  &server.Latency,
-		download: &dmbps,
-		upload:   &umbps,
-		server:   server,
-	}, nil
+// String formats the measured values for logging, leaving out the missing ones
+func (res results) String() string {
+	parts := []string{fmt.Sprintf("server: %s", res.server.Sponsor)}
+	if res.latency != nil {
+		parts = append(parts, fmt.Sprintf("ping: %3.2fms", *res.latency))
+	}
+	if res.download != nil {
+		parts = append(parts, fmt.Sprintf("download: %3.2fMbps", *res.download))
+	}
+	if res.upload != nil {
+		parts = append(parts, fmt.Sprintf("upload: %3.2fMbps", *res.upload))
+	}
+	if res.failedPhase != "" {
+		parts = append(parts, fmt.Sprintf("failed_phase: %s", res.failedPhase))
+	}
+
+	return "{" + strings.Join(parts, ", ") + "}"
 }
 
 func influxDBClient(url string, username string, password string) (client.Client, error) {
@@ -139,33 +333,35 @@ func influxDBClient(url string, username string, password string) (client.Client
 	return c, err
 }
 
-func writeMetrics(c client.Client, database string, res results) error {
+// influxDBUDPClient writes to a UDP listener, which has no auth and ignores
+// the batch database in favour of its own configured one
+func influxDBUDPClient(addr string, payloadSize int) (client.Client, error) {
+	c, err := client.NewUDPClient(client.UDPConfig{
+		Addr:        addr,
+		PayloadSize: payloadSize,
+	})
+
+	return c, err
+}
+
+func writeMetrics(c client.Client, database string, rp string, res results) error {
 	bp, err := client.NewBatchPoints(
 		client.BatchPointsConfig{
-			Database:  database,
-			Precision: "s",
+			Database:        database,
+			RetentionPolicy: rp,
+			Precision:       "s",
 		},
 	)
 	if err != nil {
 		return err
 	}
 
-	tags := map[string]string{
-		"server_name":    res.server.Name,
-		"server_id":      res.server.ID,
-		"server_sponsor": res.server.Sponsor,
-		"server_url":     res.server.URL,
-		"server_country": res.server.Country,
-	}
-
-	fields := map[string]interface{}{
-		"latency":         *res.latency,
-		"download":        *res.download,
-		"upload":          *res.upload,
-		"server_distance": res.server.Distance,
+	at := res.timestamp
+	if at.IsZero() {
+		at = time.Now()
 	}
 
-	point, err := client.NewPoint("speedtest", tags, fields, time.Now())
+	point, err := client.NewPoint("speedtest", resultTags(res), resultFields(res), at)
 	if err != nil {
 		return err
 	}
@@ -175,3 +371,57 @@ func writeMetrics(c client.Client, database string, res results) error {
 	err = c.Write(bp)
 	return err
 }
+
+// resultTags builds the point tags, server tags are left out when no server
+// was selected
+func resultTags(res results) map[string]string {
+	tags := map[string]string{
+		"status": res.status(),
+	}
+
+	if res.server.ID != "" {
+		tags["server_name"] = res.server.Name
+		tags["server_id"] = res.server.ID
+		tags["server_sponsor"] = res.server.Sponsor
+		tags["server_url"] = res.server.URL
+		tags["server_country"] = res.server.Country
+	}
+
+	if res.failedPhase != "" {
+		tags["failed_phase"] = res.failedPhase
+	}
+
+	return tags
+}
+
+// resultFields builds the point fields from the values that were measured
+func resultFields(res results) map[string]interface{} {
+	fields := map[string]interface{}{}
+
+	if res.latency != nil {
+		fields["latency"] = *res.latency
+	}
+	if res.download != nil {
+		fields["download"] = *res.download
+	}
+	if res.upload != nil {
+		fields["upload"] = *res.upload
+	}
+	if res.server.ID != "" {
+		fields["server_distance"] = res.server.Distance
+	}
+	if pct, ok := pctOf(res.download, res.plan.download); ok {
+		fields["download_pct_of_plan"] = pct
+	}
+	if pct, ok := pctOf(res.upload, res.plan.upload); ok {
+		fields["upload_pct_of_plan"] = pct
+	}
+	if res.anomaly != nil {
+		fields["anomaly_score"] = *res.anomaly
+	}
+	if res.err != nil {
+		fields["error"] = res.err.Error()
+	}
+
+	return fields
+}
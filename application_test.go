@@ -1,11 +1,16 @@
 package main
 
 import (
+	"errors"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/influxdata/influxdb/client/v2"
 	"github.com/kylegrantlucas/speedtest"
+	"github.com/kylegrantlucas/speedtest/http"
 	"github.com/urfave/cli"
 )
 
@@ -51,6 +56,7 @@ func Test_runSpeedtest(t *testing.T) {
 
 func Test_influxDBClient(t *testing.T) {
 	type args struct {
+		url      string
 		username string
 		password string
 	}
@@ -64,7 +70,7 @@ func Test_influxDBClient(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := influxDBClient(tt.args.username, tt.args.password)
+			got, err := influxDBClient(tt.args.url, tt.args.username, tt.args.password)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("influxDBClient() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -76,10 +82,40 @@ func Test_influxDBClient(t *testing.T) {
 	}
 }
 
+func Test_influxDBUDPClient(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenUDP() error = %v", err)
+	}
+	defer conn.Close()
+
+	c, err := influxDBUDPClient(conn.LocalAddr().String(), 0)
+	if err != nil {
+		t.Fatalf("influxDBUDPClient() error = %v", err)
+	}
+	defer c.Close()
+
+	res := results{failedPhase: phaseServer, err: errors.New("no such host")}
+	if err := writeMetrics(c, "speedtest", "", res); err != nil {
+		t.Fatalf("writeMetrics() error = %v", err)
+	}
+
+	buf := make([]byte, client.UDPPayloadSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("ReadFromUDP() error = %v", err)
+	}
+	if want := `speedtest,failed_phase=server,status=failed error="no such host"`; !strings.HasPrefix(string(buf[:n]), want) {
+		t.Errorf("udp payload = %q, want prefix %q", buf[:n], want)
+	}
+}
+
 func Test_writeMetrics(t *testing.T) {
 	type args struct {
 		c        client.Client
 		database string
+		rp       string
 		res      results
 	}
 	tests := []struct {
@@ -91,9 +127,191 @@ func Test_writeMetrics(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := writeMetrics(tt.args.c, tt.args.database, tt.args.res); (err != nil) != tt.wantErr {
+			if err := writeMetrics(tt.args.c, tt.args.database, tt.args.rp, tt.args.res); (err != nil) != tt.wantErr {
 				t.Errorf("writeMetrics() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+// fakeInfluxClient records what is written and queried, answering queries
+// from responses keyed by command
+type fakeInfluxClient struct {
+	writes    []client.BatchPoints
+	writeErr  error
+	pingErr   error
+	pings     int
+	queries   []string
+	responses map[string]*client.Response
+}
+
+func (f *fakeInfluxClient) Ping(timeout time.Duration) (time.Duration, string, error) {
+	f.pings++
+	return 0, "", f.pingErr
+}
+
+func (f *fakeInfluxClient) Write(bp client.BatchPoints) error {
+	f.writes = append(f.writes, bp)
+	return f.writeErr
+}
+
+func (f *fakeInfluxClient) Query(q client.Query) (*client.Response, error) {
+	f.queries = append(f.queries, q.Command)
+	if resp, ok := f.responses[q.Command]; ok {
+		return resp, nil
+	}
+
+	return &client.Response{}, nil
+}
+
+func (f *fakeInfluxClient) Close() error {
+	return nil
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+var testServer = http.Server{
+	URL:      "http://speedtest.example.com/speedtest/upload.php",
+	Name:     "Springfield",
+	Country:  "United States",
+	Sponsor:  "Example ISP",
+	ID:       "1234",
+	Distance: 12.5,
+	Latency:  9.5,
+}
+
+var testClient = http.Config{
+	IP:  "203.0.113.7",
+	Lat: 39.8,
+	Lon: -89.64,
+	Isp: "Example Broadband",
+}
+
+func Test_results_status(t *testing.T) {
+	tests := []struct {
+		name string
+		res  results
+		want string
+	}{
+		{
+			name: "all values",
+			res:  results{latency: floatPtr(9.5), download: floatPtr(100), upload: floatPtr(20)},
+			want: statusOK,
+		},
+		{
+			name: "upload missing",
+			res:  results{latency: floatPtr(9.5), download: floatPtr(100), failedPhase: phaseUpload},
+			want: statusPartial,
+		},
+		{
+			name: "no values",
+			res:  results{failedPhase: phaseServer},
+			want: statusFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.res.status(); got != tt.want {
+				t.Errorf("results.status() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_resultTags(t *testing.T) {
+	tests := []struct {
+		name string
+		res  results
+		want map[string]string
+	}{
+		{
+			name: "ok",
+			res:  results{server: testServer, latency: floatPtr(9.5), download: floatPtr(100), upload: floatPtr(20)},
+			want: map[string]string{
+				"status":         statusOK,
+				"server_name":    "Springfield",
+				"server_id":      "1234",
+				"server_sponsor": "Example ISP",
+				"server_url":     "http://speedtest.example.com/speedtest/upload.php",
+				"server_country": "United States",
+			},
+		},
+		{
+			name: "failed before server selection",
+			res:  results{failedPhase: phaseConfig, err: errors.New("timeout")},
+			want: map[string]string{
+				"status":       statusFailed,
+				"failed_phase": phaseConfig,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resultTags(tt.res); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resultTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_resultFields(t *testing.T) {
+	tests := []struct {
+		name string
+		res  results
+		want map[string]interface{}
+	}{
+		{
+			name: "ok",
+			res:  results{server: testServer, latency: floatPtr(9.5), download: floatPtr(100), upload: floatPtr(20)},
+			want: map[string]interface{}{
+				"latency":         9.5,
+				"download":        100.0,
+				"upload":          20.0,
+				"server_distance": 12.5,
+			},
+		},
+		{
+			name: "against a plan",
+			res:  results{latency: floatPtr(9.5), download: floatPtr(100), upload: floatPtr(20), plan: plan{download: 200, upload: 10}},
+			want: map[string]interface{}{
+				"latency":              9.5,
+				"download":             100.0,
+				"upload":               20.0,
+				"download_pct_of_plan": 50.0,
+				"upload_pct_of_plan":   200.0,
+			},
+		},
+		{
+			name: "partial",
+			res: results{
+				server:      testServer,
+				latency:     floatPtr(9.5),
+				download:    floatPtr(100),
+				failedPhase: phaseUpload,
+				err:         errors.New("connection reset"),
+			},
+			want: map[string]interface{}{
+				"latency":         9.5,
+				"download":        100.0,
+				"server_distance": 12.5,
+				"error":           "connection reset",
+			},
+		},
+		{
+			name: "failed",
+			res:  results{failedPhase: phaseServer, err: errors.New("no such host")},
+			want: map[string]interface{}{
+				"error": "no such host",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resultFields(tt.res); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resultFields() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// digest periods, set with --notify-digest
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+// metricStats is the running min, max and sum of one metric
+type metricStats struct {
+	count int
+	min   float64
+	max   float64
+	sum   float64
+}
+
+func (m *metricStats) add(v float64) {
+	if m.count == 0 || v < m.min {
+		m.min = v
+	}
+	if m.count == 0 || v > m.max {
+		m.max = v
+	}
+	m.count++
+	m.sum += v
+}
+
+func (m metricStats) avg() float64 {
+	if m.count == 0 {
+		return 0
+	}
+
+	return m.sum / float64(m.count)
+}
+
+// digest accumulates the results of a period, to be summarised once the
+// period is over
+type digest struct {
+	period string
+	start  time.Time
+	end    time.Time
+
+	tests    int
+	statuses map[string]int
+	latency  metricStats
+	download metricStats
+	upload   metricStats
+}
+
+func newDigest(period string, now time.Time) *digest {
+	d := &digest{period: period}
+	d.reset(now)
+
+	return d
+}
+
+// reset starts a new period at now, ending at the next local midnight, or
+// the next monday for weekly digests
+func (d *digest) reset(now time.Time) {
+	y, m, day := now.Date()
+	end := time.Date(y, m, day+1, 0, 0, 0, 0, now.Location())
+	if d.period == digestWeekly {
+		for end.Weekday() != time.Monday {
+			end = end.AddDate(0, 0, 1)
+		}
+	}
+
+	*d = digest{period: d.period, start: now, end: end, statuses: map[string]int{}}
+}
+
+func (d *digest) add(res results) {
+	d.tests++
+	d.statuses[res.status()]++
+	if res.latency != nil {
+		d.latency.add(*res.latency)
+	}
+	if res.download != nil {
+		d.download.add(*res.download)
+	}
+	if res.upload != nil {
+		d.upload.add(*res.upload)
+	}
+}
+
+// due returns the digest notification once the period is over, and starts
+// the next period. A period without results has nothing to send.
+func (d *digest) due(now time.Time) (notification, bool) {
+	if now.Before(d.end) {
+		return notification{}, false
+	}
+
+	n := d.notification()
+	tests := d.tests
+	d.reset(now)
+
+	return n, tests > 0
+}
+
+func (d *digest) notification() notification {
+	lines := []string{fmt.Sprintf("%d tests from %s to %s: %d ok, %d partial, %d failed",
+		d.tests, d.start.Format("2006-01-02 15:04"), d.end.Format("2006-01-02 15:04"),
+		d.statuses[statusOK], d.statuses[statusPartial], d.statuses[statusFailed])}
+
+	for _, metric := range []struct {
+		name  string
+		unit  string
+		stats metricStats
+	}{
+		{"Download", "Mbit/s", d.download},
+		{"Upload", "Mbit/s", d.upload},
+		{"Latency", "ms", d.latency},
+	} {
+		if metric.stats.count == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: min %.2f, avg %.2f, max %.2f %s",
+			metric.name, metric.stats.min, metric.stats.avg(), metric.stats.max, metric.unit))
+	}
+
+	return notification{
+		kind:     notifyDigest,
+		severity: severityInfo,
+		title:    strings.ToUpper(d.period[:1]) + d.period[1:] + " speedtest digest",
+		message:  strings.Join(lines, "\n"),
+		at:       d.end,
+	}
+}
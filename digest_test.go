@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_digest(t *testing.T) {
+	tests := []struct {
+		name    string
+		period  string
+		start   time.Time
+		wantEnd time.Time
+	}{
+		{"daily", digestDaily, time.Date(2018, 5, 2, 15, 30, 0, 0, time.UTC), time.Date(2018, 5, 3, 0, 0, 0, 0, time.UTC)},
+		{"weekly from wednesday", digestWeekly, time.Date(2018, 5, 2, 15, 30, 0, 0, time.UTC), time.Date(2018, 5, 7, 0, 0, 0, 0, time.UTC)},
+		{"weekly from monday", digestWeekly, time.Date(2018, 5, 7, 0, 0, 0, 0, time.UTC), time.Date(2018, 5, 14, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDigest(tt.period, tt.start)
+			if !d.end.Equal(tt.wantEnd) {
+				t.Errorf("newDigest() end = %s, want %s", d.end, tt.wantEnd)
+			}
+
+			if _, ok := d.due(tt.wantEnd.Add(-time.Second)); ok {
+				t.Errorf("due() before the end of the period = true")
+			}
+			if _, ok := d.due(tt.wantEnd); ok {
+				t.Errorf("due() without results = true")
+			}
+		})
+	}
+}
+
+func Test_digest_notification(t *testing.T) {
+	start := time.Date(2018, 5, 2, 15, 30, 0, 0, time.UTC)
+	d := newDigest(digestDaily, start)
+
+	d.add(results{latency: floatPtr(10), download: floatPtr(90), upload: floatPtr(10)})
+	d.add(results{latency: floatPtr(20), download: floatPtr(60)})
+	d.add(results{})
+
+	n, ok := d.due(time.Date(2018, 5, 3, 0, 5, 0, 0, time.UTC))
+	if !ok {
+		t.Fatal("due() after the period = false")
+	}
+
+	want := "3 tests from 2018-05-02 15:30 to 2018-05-03 00:00: 1 ok, 1 partial, 1 failed\n" +
+		"Download: min 60.00, avg 75.00, max 90.00 Mbit/s\n" +
+		"Upload: min 10.00, avg 10.00, max 10.00 Mbit/s\n" +
+		"Latency: min 10.00, avg 15.00, max 20.00 ms"
+	if n.title != "Daily speedtest digest" || n.message != want {
+		t.Errorf("due() = %q: %q, want %q", n.title, n.message, want)
+	}
+
+	if d.tests != 0 || !d.end.Equal(time.Date(2018, 5, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("due() didn't start the next period, %d tests until %s", d.tests, d.end)
+	}
+}
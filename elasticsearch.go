@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var elasticsearchFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "elasticsearch-url",
+		Usage: "Index results in the elasticsearch or opensearch cluster at this URL, disabled when empty",
+	},
+	cli.StringFlag{
+		Name:  "elasticsearch-index",
+		Value: "speedtest-{date}",
+		Usage: "The index to write to, {date} is replaced with the result's date",
+	},
+	cli.StringFlag{
+		Name:  "elasticsearch-index-date-format",
+		Value: "2006.01.02",
+		Usage: "The Go time layout {date} is formatted with",
+	},
+	cli.StringFlag{
+		Name:  "elasticsearch-template",
+		Value: "speedtest",
+		Usage: "The name of the index template installed at startup, which needs the cluster to be reachable then, empty skips installing it",
+	},
+	cli.StringFlag{
+		Name:  "elasticsearch-username",
+		Usage: "The username for elasticsearch basic auth",
+	},
+	cli.StringFlag{
+		Name:   "elasticsearch-password",
+		Usage:  "The password for elasticsearch basic auth",
+		EnvVar: "ELASTICSEARCH_PASSWORD",
+	},
+	cli.StringFlag{
+		Name:   "elasticsearch-api-key",
+		Usage:  "The base64 encoded elasticsearch API key, used instead of basic auth",
+		EnvVar: "ELASTICSEARCH_API_KEY",
+	},
+	cli.StringFlag{
+		Name:  "elasticsearch-ca-file",
+		Usage: "A PEM file of CAs to verify the cluster with, instead of the system pool",
+	},
+	cli.BoolFlag{
+		Name:  "elasticsearch-insecure-skip-verify",
+		Usage: "Don't verify the cluster's certificate",
+	},
+}
+
+// elasticsearchSink indexes each result as a document through the _bulk API,
+// which elasticsearch and opensearch both speak
+type elasticsearchSink struct {
+	url        string
+	index      string
+	dateFormat string
+	username   string
+	password   string
+	apiKey     string
+	httpClient *http.Client
+}
+
+func newElasticsearchSink(c *cli.Context) (sink, error) {
+	if c.String("elasticsearch-url") == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(c.String("elasticsearch-url"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid elasticsearch url: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported elasticsearch url scheme %q", u.Scheme)
+	}
+
+	tlsConfig, err := clientTLSConfig("", c.String("elasticsearch-ca-file"), c.Bool("elasticsearch-insecure-skip-verify"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &elasticsearchSink{
+		url:        strings.TrimSuffix(u.String(), "/"),
+		index:      c.String("elasticsearch-index"),
+		dateFormat: c.String("elasticsearch-index-date-format"),
+		username:   c.String("elasticsearch-username"),
+		password:   c.String("elasticsearch-password"),
+		apiKey:     c.String("elasticsearch-api-key"),
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+
+	if c.String("elasticsearch-template") != "" {
+		err = s.installTemplate(c.String("elasticsearch-template"))
+		if err != nil {
+			return nil, fmt.Errorf("error installing elasticsearch index template: %v, set --elasticsearch-template= to skip it", err)
+		}
+	}
+
+	return s, nil
+}
+
+// installTemplate puts the index template, so every daily index gets the
+// same mappings with the locations as geo points
+func (s *elasticsearchSink) installTemplate(name string) error {
+	body, err := json.Marshal(elasticsearchTemplate(s.index))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.do("PUT", "/_index_template/"+url.PathEscape(name), "application/json", body)
+	return err
+}
+
+// elasticsearchTemplate matches every index the pattern can produce
+func elasticsearchTemplate(index string) map[string]interface{} {
+	pattern := index
+	if i := strings.Index(index, "{date}"); i >= 0 {
+		pattern = index[:i] + "*"
+	}
+
+	keyword := map[string]string{"type": "keyword"}
+	double := map[string]string{"type": "double"}
+	geoPoint := map[string]string{"type": "geo_point"}
+
+	return map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"@timestamp":           map[string]string{"type": "date"},
+					"duration_seconds":     double,
+					"status":               keyword,
+					"failed_phase":         keyword,
+					"error":                map[string]string{"type": "text"},
+					"latency":              double,
+					"download":             double,
+					"upload":               double,
+					"download_pct_of_plan": double,
+					"upload_pct_of_plan":   double,
+					"anomaly_score":        double,
+					"server_id":            keyword,
+					"server_name":          keyword,
+					"server_sponsor":       keyword,
+					"server_url":           keyword,
+					"server_country":       keyword,
+					"server_distance":      double,
+					"server_location":      geoPoint,
+					"client_ip":            map[string]string{"type": "ip"},
+					"client_isp":           keyword,
+					"client_location":      geoPoint,
+				},
+			},
+		},
+	}
+}
+
+func (s *elasticsearchSink) Name() string {
+	return "elasticsearch"
+}
+
+func (s *elasticsearchSink) WriteResult(res results) error {
+	action, err := json.Marshal(map[string]interface{}{
+		"index": map[string]string{"_index": s.indexName(res.timestamp)},
+	})
+	if err != nil {
+		return err
+	}
+
+	doc, err := json.Marshal(elasticsearchDocument(res))
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	body.Write(action)
+	body.WriteByte('\n')
+	body.Write(doc)
+	body.WriteByte('\n')
+
+	resp, err := s.do("POST", "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return bulkError(resp)
+}
+
+// indexName formats the index for a result's UTC date
+func (s *elasticsearchSink) indexName(at time.Time) string {
+	return strings.Replace(s.index, "{date}", at.UTC().Format(s.dateFormat), -1)
+}
+
+// elasticsearchDocument is the flat result document, with the locations as
+// geo points
+func elasticsearchDocument(res results) map[string]interface{} {
+	doc := resultJSON(res)
+	doc["@timestamp"] = doc["timestamp"]
+	delete(doc, "timestamp")
+
+	if res.server.ID != "" {
+		doc["server_location"] = map[string]float64{"lat": res.server.Lat, "lon": res.server.Lon}
+	}
+	if res.client.IP != "" {
+		doc["client_ip"] = res.client.IP
+		doc["client_isp"] = res.client.Isp
+		doc["client_location"] = map[string]float64{"lat": res.client.Lat, "lon": res.client.Lon}
+	}
+
+	return doc
+}
+
+// bulkError returns the first item error of a bulk response, which reports
+// them with a 200
+func bulkError(body []byte) error {
+	var resp struct {
+		Errors bool
+		Items  []map[string]struct {
+			Status int
+			Error  json.RawMessage
+		}
+	}
+
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return fmt.Errorf("error decoding bulk response: %v", err)
+	}
+	if !resp.Errors {
+		return nil
+	}
+
+	for _, item := range resp.Items {
+		for action, result := range item {
+			if result.Error != nil {
+				return fmt.Errorf("bulk %s returned %d: %s", action, result.Status, result.Error)
+			}
+		}
+	}
+
+	return fmt.Errorf("bulk request reported errors")
+}
+
+func (s *elasticsearchSink) do(method string, path string, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "speedtest-to-influxdb")
+	if s.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("elasticsearch returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return msg, nil
+}
+
+func (s *elasticsearchSink) Close() error {
+	return nil
+}
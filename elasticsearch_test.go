@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_elasticsearchSink_WriteResult(t *testing.T) {
+	res := results{
+		server:    testServer,
+		client:    testClient,
+		latency:   floatPtr(9.5),
+		download:  floatPtr(94.2),
+		upload:    floatPtr(11.7),
+		timestamp: time.Date(2018, 5, 5, 23, 59, 0, 0, time.FixedZone("", -3600)),
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		wantErr  bool
+	}{
+		{"indexed", `{"errors":false,"items":[{"index":{"status":201}}]}`, false},
+		{"item rejected", `{"errors":true,"items":[{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/_bulk" || r.Header.Get("Authorization") != "ApiKey a2V5" {
+					t.Errorf("request = %s with %q, want /_bulk with the API key", r.URL.Path, r.Header.Get("Authorization"))
+				}
+
+				lines := bufio.NewScanner(r.Body)
+				var action, doc map[string]interface{}
+				lines.Scan()
+				json.Unmarshal(lines.Bytes(), &action)
+				lines.Scan()
+				json.Unmarshal(lines.Bytes(), &doc)
+
+				wantAction := map[string]interface{}{"index": map[string]interface{}{"_index": "speedtest-2018.05.06"}}
+				if !reflect.DeepEqual(action, wantAction) {
+					t.Errorf("action = %v, want %v", action, wantAction)
+				}
+				if doc["@timestamp"] != "2018-05-06T00:59:00Z" || doc["client_ip"] != "203.0.113.7" {
+					t.Errorf("document = %v, want the UTC timestamp and client ip", doc)
+				}
+				wantLocation := map[string]interface{}{"lat": 39.8, "lon": -89.64}
+				if !reflect.DeepEqual(doc["client_location"], wantLocation) {
+					t.Errorf("client_location = %v, want %v", doc["client_location"], wantLocation)
+				}
+
+				w.Write([]byte(tt.response))
+			}))
+			defer srv.Close()
+
+			s := &elasticsearchSink{
+				url:        srv.URL,
+				index:      "speedtest-{date}",
+				dateFormat: "2006.01.02",
+				apiKey:     "a2V5",
+				httpClient: srv.Client(),
+			}
+			if err := s.WriteResult(res); (err != nil) != tt.wantErr {
+				t.Errorf("WriteResult() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_elasticsearchTemplate(t *testing.T) {
+	tests := []struct {
+		index string
+		want  []string
+	}{
+		{"speedtest-{date}", []string{"speedtest-*"}},
+		{"speedtest", []string{"speedtest"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.index, func(t *testing.T) {
+			if got := elasticsearchTemplate(tt.index)["index_patterns"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("elasticsearchTemplate() index_patterns = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_elasticsearchTemplate_numericFields(t *testing.T) {
+	res := results{
+		server:   testServer,
+		latency:  floatPtr(9.5),
+		download: floatPtr(94),
+		upload:   floatPtr(12),
+		plan:     plan{download: 100, upload: 20},
+		anomaly:  floatPtr(3),
+	}
+
+	// dynamic mapping would make a whole number a long
+	properties := elasticsearchTemplate("speedtest")["template"].(map[string]interface{})["mappings"].(map[string]interface{})["properties"].(map[string]interface{})
+	for name, v := range resultFields(res) {
+		if _, ok := v.(float64); !ok {
+			continue
+		}
+		if got, _ := properties[name].(map[string]string); got["type"] != "double" {
+			t.Errorf("%s is mapped as %v, want double", name, properties[name])
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var emailFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "notify-smtp-addr",
+		Usage: "Email notifications through the SMTP server at this host:port, disabled when empty",
+	},
+	cli.StringFlag{
+		Name:  "notify-smtp-tls",
+		Value: "starttls",
+		Usage: "How to secure the SMTP connection, starttls, tls (implicit, usually port 465) or none",
+	},
+	cli.StringFlag{
+		Name:  "notify-smtp-username",
+		Usage: "The username for SMTP auth, which needs TLS unless the server is local",
+	},
+	cli.StringFlag{
+		Name:   "notify-smtp-password",
+		Usage:  "The password for SMTP auth",
+		EnvVar: "NOTIFY_SMTP_PASSWORD",
+	},
+	cli.StringFlag{
+		Name:  "notify-smtp-ca-file",
+		Usage: "A PEM file of CAs to verify the SMTP server with, instead of the system pool",
+	},
+	cli.BoolFlag{
+		Name:  "notify-smtp-insecure-skip-verify",
+		Usage: "Don't verify the SMTP server's certificate",
+	},
+	cli.StringFlag{
+		Name:  "notify-email-from",
+		Usage: "The address emails are sent from",
+	},
+	cli.StringFlag{
+		Name:  "notify-email-to",
+		Usage: "The comma separated addresses emails are sent to",
+	},
+	cli.StringFlag{
+		Name:  "notify-email-on",
+		Value: "outage,threshold,anomaly,digest",
+		Usage: "What to email about, instead of --notify-on, as it's a slower channel",
+	},
+}
+
+// emailNotifier sends each notification as a plain text email
+type emailNotifier struct {
+	addr      string
+	host      string
+	mode      string
+	tlsConfig *tls.Config
+	username  string
+	password  string
+	from      string
+	to        []string
+	kinds     map[string]bool
+	now       func() time.Time
+}
+
+func newEmailNotifier(c *cli.Context) (notifier, error) {
+	if c.String("notify-smtp-addr") == "" {
+		return nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(c.String("notify-smtp-addr"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp address: %v", err)
+	}
+
+	mode := c.String("notify-smtp-tls")
+	if mode != "starttls" && mode != "tls" && mode != "none" {
+		return nil, fmt.Errorf("unsupported smtp tls mode %q", mode)
+	}
+
+	var to []string
+	for _, addr := range strings.Split(c.String("notify-email-to"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	if c.String("notify-email-from") == "" || len(to) == 0 {
+		return nil, fmt.Errorf("--notify-email-from and --notify-email-to are required to send email")
+	}
+
+	kinds, err := parseNotifyKinds(c.String("notify-email-on"))
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := clientTLSConfig(host, c.String("notify-smtp-ca-file"), c.Bool("notify-smtp-insecure-skip-verify"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &emailNotifier{
+		addr:      c.String("notify-smtp-addr"),
+		host:      host,
+		mode:      mode,
+		tlsConfig: tlsConfig,
+		username:  c.String("notify-smtp-username"),
+		password:  c.String("notify-smtp-password"),
+		from:      c.String("notify-email-from"),
+		to:        to,
+		kinds:     kinds,
+		now:       time.Now,
+	}, nil
+}
+
+func (n *emailNotifier) Name() string {
+	return "email"
+}
+
+func (n *emailNotifier) notifyKinds() map[string]bool {
+	return n.kinds
+}
+
+func (n *emailNotifier) Notify(msg notification) error {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if n.mode == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", n.addr, n.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", n.addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if n.mode == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s doesn't support STARTTLS", n.addr)
+		}
+		err = c.StartTLS(n.tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n.username != "" {
+		err = c.Auth(smtp.PlainAuth("", n.username, n.password, n.host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(n.from)
+	if err != nil {
+		return err
+	}
+	for _, to := range n.to {
+		err = c.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(n.message(msg))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// message formats the notification as a plain text email
+func (n *emailNotifier) message(msg notification) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[speedtest] "+msg.title))
+	fmt.Fprintf(&b, "Date: %s\r\n", n.now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(msg.message, "\n", "\r\n", -1))
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a local SMTP stand-in that accepts one message
+type fakeSMTP struct {
+	listener net.Listener
+	auth     string
+	rcpts    []string
+	data     string
+	done     chan struct{}
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSMTP{listener: l, done: make(chan struct{})}
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeSMTP) serve() {
+	defer close(s.done)
+
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(lines string) { conn.Write([]byte(lines + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch cmd {
+		case "EHLO":
+			reply("250-localhost\r\n250 AUTH PLAIN")
+		case "AUTH":
+			decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN "))
+			s.auth = string(decoded)
+			reply("235 ok")
+		case "MAIL":
+			reply("250 ok")
+		case "RCPT":
+			s.rcpts = append(s.rcpts, line)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				data = append(data, l)
+			}
+			s.data = strings.Join(data, "")
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unsupported")
+		}
+	}
+}
+
+func Test_emailNotifier_Notify(t *testing.T) {
+	smtp := newFakeSMTP(t)
+	defer smtp.listener.Close()
+
+	n := &emailNotifier{
+		addr:     smtp.listener.Addr().String(),
+		host:     "127.0.0.1",
+		mode:     "none",
+		username: "probe",
+		password: "secret",
+		from:     "speedtest@example.com",
+		to:       []string{"ops@example.com", "site@example.com"},
+		now:      func() time.Time { return time.Unix(1500000000, 0).UTC() },
+	}
+
+	err := n.Notify(notification{
+		kind:     notifyOutage,
+		severity: severityCritical,
+		title:    "Outage started",
+		message:  "Connectivity lost\nat noon",
+	})
+	if err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	<-smtp.done
+
+	if smtp.auth != "\x00probe\x00secret" {
+		t.Errorf("auth = %q, want PLAIN probe:secret", smtp.auth)
+	}
+	if len(smtp.rcpts) != 2 {
+		t.Errorf("recipients = %v, want 2", smtp.rcpts)
+	}
+
+	want := "From: speedtest@example.com\r\n" +
+		"To: ops@example.com, site@example.com\r\n" +
+		"Subject: [speedtest] Outage started\r\n" +
+		"Date: Fri, 14 Jul 2017 02:40:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"Connectivity lost\r\nat noon\r\n"
+	if smtp.data != want {
+		t.Errorf("message = %q, want %q", smtp.data, want)
+	}
+}
+
+func Test_emailNotifier_requiresSTARTTLS(t *testing.T) {
+	smtp := newFakeSMTP(t)
+	defer smtp.listener.Close()
+
+	n := &emailNotifier{addr: smtp.listener.Addr().String(), host: "127.0.0.1", mode: "starttls"}
+	if err := n.Notify(notification{}); err == nil {
+		t.Errorf("Notify() error = nil, want an error without STARTTLS")
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var fileFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "file-path",
+		Usage: "Append results to this file, - for stdout, disabled when empty",
+	},
+	cli.StringFlag{
+		Name:  "file-format",
+		Value: "csv",
+		Usage: "The file format, csv or jsonl",
+	},
+	cli.IntFlag{
+		Name:  "file-rotate-size",
+		Usage: "Rotate the file once it reaches this many megabytes, 0 disables",
+	},
+	cli.BoolFlag{
+		Name:  "file-rotate-daily",
+		Usage: "Rotate the file when the day changes",
+	},
+	cli.BoolFlag{
+		Name:  "file-gzip",
+		Usage: "Compress rotated files with gzip",
+	},
+}
+
+// fileColumns is the CSV header, the tags and fields written by
+// writeMetrics. Only ever append to it, so old columns keep their position.
+// A file with a different header is rotated when it's opened rather than
+// appended to.
+var fileColumns = []string{
+	"timestamp",
+	"duration_seconds",
+	"status",
+	"failed_phase",
+	"server_id",
+	"server_name",
+	"server_sponsor",
+	"server_url",
+	"server_country",
+	"server_distance",
+	"latency",
+	"download",
+	"upload",
+	"error",
+	"download_pct_of_plan",
+	"upload_pct_of_plan",
+	"anomaly_score",
+}
+
+// fileSink appends every result to a local file or stdout, rotating the file
+// by size or day
+type fileSink struct {
+	path       string
+	jsonl      bool
+	rotateSize int64
+	daily      bool
+	gzip       bool
+
+	out    io.Writer
+	file   *os.File
+	size   int64
+	opened time.Time
+	header bool
+}
+
+func newFileSink(c *cli.Context) (sink, error) {
+	if c.String("file-path") == "" {
+		return nil, nil
+	}
+
+	format := c.String("file-format")
+	if format != "csv" && format != "jsonl" {
+		return nil, fmt.Errorf("unsupported file format %q", format)
+	}
+
+	s := &fileSink{
+		path:       c.String("file-path"),
+		jsonl:      format == "jsonl",
+		rotateSize: int64(c.Int("file-rotate-size")) << 20,
+		daily:      c.Bool("file-rotate-daily"),
+		gzip:       c.Bool("file-gzip"),
+	}
+
+	if s.path == "-" {
+		s.out = os.Stdout
+		return s, nil
+	}
+
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// open opens the file for appending, rotating a CSV file that was written
+// with different columns
+func (s *fileSink) open() error {
+	err := s.openFile()
+	if err != nil {
+		return err
+	}
+
+	if !s.jsonl && s.size > 0 {
+		matches, err := s.headerMatches()
+		if err != nil {
+			s.file.Close()
+			s.file, s.out = nil, nil
+			return err
+		}
+		if !matches {
+			log.Printf("%s was written with different columns, rotating it", s.path)
+			return s.rotate()
+		}
+	}
+
+	return nil
+}
+
+// openFile opens the file for appending as it is, a new or empty file gets
+// a CSV header with its first record
+func (s *fileSink) openFile() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file, s.out = f, f
+	s.size = info.Size()
+	s.opened = info.ModTime()
+	s.header = s.size > 0
+	if s.size == 0 {
+		s.opened = time.Now()
+	}
+
+	return nil
+}
+
+// headerMatches reports whether the file starts with the current CSV header
+func (s *fileSink) headerMatches() (bool, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	header, err := encodeCSV(fileColumns)
+	if err != nil {
+		return false, err
+	}
+
+	return line == string(header), nil
+}
+
+func (s *fileSink) Name() string {
+	return "file"
+}
+
+func (s *fileSink) WriteResult(res results) error {
+	record, err := s.encode(res)
+	if err != nil {
+		return err
+	}
+
+	if s.file != nil && s.needsRotation(len(record), res.timestamp) {
+		err = s.rotate()
+		if err != nil {
+			log.Printf("error rotating %s: %v", s.path, err)
+		}
+	}
+
+	// a failed rotation leaves the file closed, so carry on appending to
+	// whatever is at the path
+	if s.out == nil {
+		err = s.openFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !s.jsonl && !s.header {
+		header, err := encodeCSV(fileColumns)
+		if err != nil {
+			return err
+		}
+		record = append(header, record...)
+		s.header = true
+	}
+
+	n, err := s.out.Write(record)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) encode(res results) ([]byte, error) {
+	if s.jsonl {
+		b, err := json.Marshal(resultJSON(res))
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	}
+
+	return encodeCSV(resultRecord(res))
+}
+
+// needsRotation reports whether the next record belongs in a new file
+func (s *fileSink) needsRotation(next int, at time.Time) bool {
+	if s.size == 0 {
+		return false
+	}
+
+	if s.rotateSize > 0 && s.size+int64(next) > s.rotateSize {
+		return true
+	}
+
+	if s.daily {
+		y1, m1, d1 := s.opened.Date()
+		y2, m2, d2 := at.Date()
+		return y1 != y2 || m1 != m2 || d1 != d2
+	}
+
+	return false
+}
+
+// rotate moves the current file aside, named after when it was started, and
+// opens a fresh one. The file is left closed if that fails.
+func (s *fileSink) rotate() error {
+	err := s.file.Close()
+	s.file, s.out = nil, nil
+	if err != nil {
+		return err
+	}
+
+	rotated := s.rotatedName()
+	err = os.Rename(s.path, rotated)
+	if err != nil {
+		return err
+	}
+
+	if s.gzip {
+		err = gzipFile(rotated)
+		if err != nil {
+			log.Printf("error compressing %s: %v", rotated, err)
+		}
+	}
+
+	return s.openFile()
+}
+
+// rotatedName is the path plus when the file was started, with a sequence
+// number when a file started in the same second has already been rotated
+func (s *fileSink) rotatedName() string {
+	base := s.path + "." + s.opened.Format("20060102-150405")
+	name := base
+	for i := 1; fileExists(name) || fileExists(name+".gz"); i++ {
+		name = fmt.Sprintf("%s.%d", base, i)
+	}
+
+	return name
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func (s *fileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	return s.file.Close()
+}
+
+// resultRecord lays a result out in fileColumns order, with values that
+// weren't measured left empty
+func resultRecord(res results) []string {
+	tags, fields := resultTags(res), resultFields(res)
+
+	record := make([]string, len(fileColumns))
+	for i, column := range fileColumns {
+		switch column {
+		case "timestamp":
+			record[i] = res.timestamp.UTC().Format(time.RFC3339)
+		case "duration_seconds":
+			record[i] = strconv.FormatFloat(res.duration.Seconds(), 'f', -1, 64)
+		default:
+			if v, ok := tags[column]; ok {
+				record[i] = v
+			} else if v, ok := fields[column].(float64); ok {
+				record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			} else if v, ok := fields[column].(string); ok {
+				record[i] = v
+			}
+		}
+	}
+
+	return record
+}
+
+func encodeCSV(record []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(record)
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// gzipFile replaces path with a compressed path.gz
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, bufio.NewReader(in))
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
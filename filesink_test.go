@@ -0,0 +1,221 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_resultRecord(t *testing.T) {
+	at := time.Unix(1500000000, 0)
+	tests := []struct {
+		name string
+		res  results
+		want []string
+	}{
+		{
+			name: "complete results",
+			res: results{
+				server:    testServer,
+				latency:   floatPtr(9.5),
+				download:  floatPtr(94.2),
+				upload:    floatPtr(11.7),
+				timestamp: at,
+				duration:  1500 * time.Millisecond,
+				plan:      plan{download: 100, upload: 10},
+				anomaly:   floatPtr(0.5),
+			},
+			want: []string{
+				"2017-07-14T02:40:00Z", "1.5", "ok", "",
+				"1234", "Springfield", "Example ISP", "http://speedtest.example.com/speedtest/upload.php", "United States", "12.5",
+				"9.5", "94.2", "11.7", "",
+				"94.2", "117", "0.5",
+			},
+		},
+		{
+			name: "failed before selecting a server",
+			res: results{
+				failedPhase: phaseConfig,
+				err:         errors.New("no route to host"),
+				timestamp:   at,
+			},
+			want: []string{
+				"2017-07-14T02:40:00Z", "0", "failed", "config",
+				"", "", "", "", "", "",
+				"", "", "", "no route to host",
+				"", "", "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resultRecord(tt.res); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resultRecord() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_fileSink_rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &fileSink{path: filepath.Join(dir, "results.csv"), daily: true, gzip: true}
+	if err = s.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	for _, at := range []time.Time{now, now, now.AddDate(0, 0, 1)} {
+		if err = s.WriteResult(results{timestamp: at}); err != nil {
+			t.Fatalf("WriteResult() error = %v", err)
+		}
+	}
+
+	current, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(current), "\n"); lines != 2 {
+		t.Errorf("current file has %d lines, want a header and one record", lines)
+	}
+
+	rotated, err := filepath.Glob(s.path + ".*.gz")
+	if err != nil || len(rotated) != 1 {
+		t.Fatalf("rotated files = %v, want one gzipped file", rotated)
+	}
+
+	f, err := os.Open(rotated[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(old), strings.Join(fileColumns, ",")+"\n") {
+		t.Errorf("rotated file doesn't start with the header: %q", old)
+	}
+	if lines := strings.Count(string(old), "\n"); lines != 3 {
+		t.Errorf("rotated file has %d lines, want a header and two records", lines)
+	}
+}
+
+func Test_fileSink_openRotatesOldHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a file written before the plan and anomaly columns were added
+	path := filepath.Join(dir, "results.csv")
+	old := strings.Join(fileColumns[:14], ",") + "\n2017-07-14T02:40:00Z,1.5,ok,,,,,,,,9.5,94.2,11.7,\n"
+	if err = ioutil.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fileSink{path: path}
+	if err = s.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.WriteResult(results{timestamp: time.Now()}); err != nil {
+		t.Fatalf("WriteResult() error = %v", err)
+	}
+
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(current), strings.Join(fileColumns, ",")+"\n") {
+		t.Errorf("new file doesn't start with the current header: %q", current)
+	}
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil || len(rotated) != 1 {
+		t.Fatalf("rotated files = %v, want the old file moved aside", rotated)
+	}
+	if b, _ := ioutil.ReadFile(rotated[0]); string(b) != old {
+		t.Errorf("rotated file = %q, want %q", b, old)
+	}
+}
+
+func Test_fileSink_rotateSameSecond(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// every record rotates the file, several times within a second
+	s := &fileSink{path: filepath.Join(dir, "results.jsonl"), jsonl: true, rotateSize: 1}
+	if err = s.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 4; i++ {
+		if err = s.WriteResult(results{timestamp: time.Now()}); err != nil {
+			t.Fatalf("WriteResult() error = %v", err)
+		}
+	}
+
+	rotated, err := filepath.Glob(s.path + ".*")
+	if err != nil || len(rotated) != 3 {
+		t.Errorf("rotated files = %v, want 3 with none overwritten", rotated)
+	}
+}
+
+func Test_fileSink_rotateFailureRecovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &fileSink{path: filepath.Join(dir, "results.csv"), rotateSize: 1}
+	if err = s.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.WriteResult(results{timestamp: time.Now()}); err != nil {
+		t.Fatalf("WriteResult() error = %v", err)
+	}
+
+	// with the directory gone the rotation and the write fail
+	os.RemoveAll(dir)
+	if err = s.WriteResult(results{timestamp: time.Now()}); err == nil {
+		t.Fatal("WriteResult() error = nil, want the directory to be missing")
+	}
+
+	// once it's back writes carry on into a fresh file
+	if err = os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.WriteResult(results{timestamp: time.Now()}); err != nil {
+		t.Fatalf("WriteResult() after the directory came back error = %v", err)
+	}
+	current, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(current), "\n"); lines != 2 {
+		t.Errorf("file has %d lines, want a header and one record", lines)
+	}
+}
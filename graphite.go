@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var graphiteFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "graphite-addr",
+		Usage: "Send results to the carbon listener at this host:port, disabled when empty",
+	},
+	cli.StringFlag{
+		Name:  "graphite-protocol",
+		Value: "tcp",
+		Usage: "The protocol to send to carbon with, tcp or udp",
+	},
+	cli.StringFlag{
+		Name:  "graphite-format",
+		Value: "plaintext",
+		Usage: "The carbon format to send, plaintext or pickle (tcp only)",
+	},
+	cli.StringFlag{
+		Name:  "graphite-template",
+		Value: "speedtest.{server_country}.{server_id}.{field}",
+		Usage: "The metric path template, {field} and any influxDB tag in braces are replaced",
+	},
+}
+
+// graphiteSink sends every numeric field to carbon, with its path built from
+// the template
+type graphiteSink struct {
+	addr     string
+	protocol string
+	pickle   bool
+	template string
+}
+
+func newGraphiteSink(c *cli.Context) (sink, error) {
+	if c.String("graphite-addr") == "" {
+		return nil, nil
+	}
+
+	protocol, format := c.String("graphite-protocol"), c.String("graphite-format")
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, fmt.Errorf("unsupported graphite protocol %q", protocol)
+	}
+	if format != "plaintext" && format != "pickle" {
+		return nil, fmt.Errorf("unsupported graphite format %q", format)
+	}
+	if format == "pickle" && protocol != "tcp" {
+		return nil, fmt.Errorf("carbon only accepts pickle over tcp")
+	}
+
+	return &graphiteSink{
+		addr:     c.String("graphite-addr"),
+		protocol: protocol,
+		pickle:   format == "pickle",
+		template: c.String("graphite-template"),
+	}, nil
+}
+
+func (s *graphiteSink) Name() string {
+	return "graphite"
+}
+
+// graphiteMetric is one path and value sent to carbon
+type graphiteMetric struct {
+	path  string
+	value float64
+}
+
+func (s *graphiteSink) WriteResult(res results) error {
+	metrics := graphiteMetrics(s.template, res)
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	var payload []byte
+	if s.pickle {
+		payload = encodePickle(metrics, res.timestamp)
+	} else {
+		payload = encodePlaintext(metrics, res.timestamp)
+	}
+
+	conn, err := net.DialTimeout(s.protocol, s.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write(payload)
+	return err
+}
+
+func (s *graphiteSink) Close() error {
+	return nil
+}
+
+// graphiteMetrics expands the template for each numeric field of the result
+func graphiteMetrics(template string, res results) []graphiteMetric {
+	tags := resultTags(res)
+	if !strings.Contains(template, "{field}") {
+		template += ".{field}"
+	}
+
+	var metrics []graphiteMetric
+	for field, v := range resultFields(res) {
+		value, ok := v.(float64)
+		if !ok {
+			continue
+		}
+
+		metrics = append(metrics, graphiteMetric{
+			path:  expandGraphitePath(template, field, tags),
+			value: value,
+		})
+	}
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].path < metrics[j].path })
+	return metrics
+}
+
+var graphitePlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+func expandGraphitePath(template string, field string, tags map[string]string) string {
+	return graphitePlaceholder.ReplaceAllStringFunc(template, func(m string) string {
+		name := m[1 : len(m)-1]
+		if name == "field" {
+			return field
+		}
+
+		value, ok := tags[name]
+		if !ok || value == "" {
+			return "unknown"
+		}
+		return sanitizeGraphiteNode(value)
+	})
+}
+
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// sanitizeGraphiteNode makes a tag value safe to use as a single path node,
+// dots and spaces in sponsor names would otherwise split or break the path
+func sanitizeGraphiteNode(value string) string {
+	return strings.Trim(graphiteUnsafe.ReplaceAllString(value, "_"), "_")
+}
+
+func encodePlaintext(metrics []graphiteMetric, at time.Time) []byte {
+	var b bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "%s %v %d\n", m.path, m.value, at.Unix())
+	}
+
+	return b.Bytes()
+}
+
+// encodePickle builds the length-prefixed protocol 2 pickle of a list of
+// (path, (timestamp, value)) tuples that carbon's pickle receiver expects
+func encodePickle(metrics []graphiteMetric, at time.Time) []byte {
+	var p bytes.Buffer
+	p.WriteString("\x80\x02]q\x00(")
+	for _, m := range metrics {
+		p.WriteByte('X')
+		binary.Write(&p, binary.LittleEndian, uint32(len(m.path)))
+		p.WriteString(m.path)
+
+		p.WriteByte('J')
+		binary.Write(&p, binary.LittleEndian, int32(at.Unix()))
+		p.WriteByte('G')
+		binary.Write(&p, binary.BigEndian, math.Float64bits(m.value))
+		p.WriteString("\x86\x86")
+	}
+	p.WriteString("e.")
+
+	out := make([]byte, 4, 4+p.Len())
+	binary.BigEndian.PutUint32(out, uint32(p.Len()))
+	return append(out, p.Bytes()...)
+}
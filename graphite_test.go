@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_graphiteMetrics(t *testing.T) {
+	server := testServer
+	server.Sponsor = "Example I.S.P. (Fiber)"
+
+	tests := []struct {
+		name     string
+		template string
+		res      results
+		want     []graphiteMetric
+	}{
+		{
+			name:     "field placeholder",
+			template: "speedtest.{server_country}.{server_sponsor}.{field}",
+			res:      results{server: server, latency: floatPtr(9.5), download: floatPtr(100), upload: floatPtr(20)},
+			want: []graphiteMetric{
+				{"speedtest.United_States.Example_I_S_P_Fiber.download", 100},
+				{"speedtest.United_States.Example_I_S_P_Fiber.latency", 9.5},
+				{"speedtest.United_States.Example_I_S_P_Fiber.server_distance", 12.5},
+				{"speedtest.United_States.Example_I_S_P_Fiber.upload", 20},
+			},
+		},
+		{
+			name:     "field appended and missing tags",
+			template: "speedtest.{server_id}",
+			res:      results{latency: floatPtr(9.5), failedPhase: phaseDownload},
+			want: []graphiteMetric{
+				{"speedtest.unknown.latency", 9.5},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := graphiteMetrics(tt.template, tt.res); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("graphiteMetrics() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_graphiteSink_WriteResult(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	lines := make(chan string, 8)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	s := &graphiteSink{addr: l.Addr().String(), protocol: "tcp", template: "speedtest.{server_id}.{field}"}
+	err = s.WriteResult(results{latency: floatPtr(9.5), download: floatPtr(100), timestamp: time.Unix(1525500000, 0)})
+	if err != nil {
+		t.Fatalf("graphiteSink.WriteResult() error = %v", err)
+	}
+
+	var got []string
+	for line := range lines {
+		got = append(got, line)
+	}
+	want := []string{
+		"speedtest.unknown.download 100 1525500000",
+		"speedtest.unknown.latency 9.5 1525500000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("carbon received %q, want %q", got, want)
+	}
+}
+
+func Test_encodePickle(t *testing.T) {
+	got := encodePickle([]graphiteMetric{{"a.b", 1}}, time.Unix(1525500000, 0))
+	want := "\x00\x00\x00\x20" +
+		"\x80\x02]q\x00(" +
+		"X\x03\x00\x00\x00a.b" +
+		"J\x60\x48\xed\x5a" +
+		"G\x3f\xf0\x00\x00\x00\x00\x00\x00" +
+		"\x86\x86e."
+	if string(got) != want {
+		t.Errorf("encodePickle() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/urfave/cli"
+)
+
+var historyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "sqlite-path",
+		Usage: "Record every cycle in the SQLite database at this path, disabled when empty",
+	},
+	cli.IntFlag{
+		Name:  "sqlite-retention-days",
+		Value: 365,
+		Usage: "The number of days of history to keep, 0 keeps everything",
+	},
+}
+
+// historyMigrations are applied in order, each exactly once, with the number
+// applied tracked in schema_migrations. Only ever append to this list.
+var historyMigrations = []string{
+	`CREATE TABLE results (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp INTEGER NOT NULL,
+		duration_seconds REAL NOT NULL,
+		status TEXT NOT NULL,
+		failed_phase TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		latency REAL,
+		download REAL,
+		upload REAL,
+		server_id TEXT NOT NULL DEFAULT '',
+		server_name TEXT NOT NULL DEFAULT '',
+		server_sponsor TEXT NOT NULL DEFAULT '',
+		server_url TEXT NOT NULL DEFAULT '',
+		server_country TEXT NOT NULL DEFAULT '',
+		server_cc TEXT NOT NULL DEFAULT '',
+		server_lat REAL,
+		server_lon REAL,
+		server_distance REAL
+	);
+	CREATE INDEX results_timestamp ON results (timestamp);`,
+	`ALTER TABLE results ADD COLUMN client_ip TEXT NOT NULL DEFAULT '';
+	ALTER TABLE results ADD COLUMN client_isp TEXT NOT NULL DEFAULT '';
+	ALTER TABLE results ADD COLUMN client_lat REAL;
+	ALTER TABLE results ADD COLUMN client_lon REAL;`,
+	`ALTER TABLE results ADD COLUMN anomaly_score REAL;`,
+}
+
+// historyStore is the local record of every cycle, kept whether or not any
+// other sink is configured
+type historyStore struct {
+	db        *sql.DB
+	insert    *sql.Stmt
+	retention time.Duration
+}
+
+func newHistorySink(c *cli.Context) (sink, error) {
+	if c.String("sqlite-path") == "" {
+		return nil, nil
+	}
+
+	h, err := openHistory(c.String("sqlite-path"))
+	if err != nil {
+		return nil, err
+	}
+	h.retention = time.Duration(c.Int("sqlite-retention-days")) * 24 * time.Hour
+
+	return h, nil
+}
+
+// openHistory opens the database, creating and migrating it as needed
+func openHistory(path string) (*historyStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("error opening sqlite history: %v", err)
+	}
+
+	// sqlite allows a single writer, one connection avoids lock contention
+	db.SetMaxOpenConns(1)
+
+	err = migrateHistory(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating sqlite history: %v", err)
+	}
+
+	insert, err := db.Prepare(`INSERT INTO results (
+		timestamp, duration_seconds, status, failed_phase, error, latency, download, upload,
+		server_id, server_name, server_sponsor, server_url, server_country, server_cc,
+		server_lat, server_lon, server_distance, client_ip, client_isp, client_lat, client_lon, anomaly_score
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &historyStore{db: db, insert: insert}, nil
+}
+
+func migrateHistory(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(historyMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(historyMigrations[i])
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		log.Printf("applied sqlite history migration %d", i+1)
+	}
+
+	return nil
+}
+
+func (h *historyStore) Name() string {
+	return "sqlite"
+}
+
+func (h *historyStore) WriteResult(res results) error {
+	var errText string
+	if res.err != nil {
+		errText = res.err.Error()
+	}
+
+	var lat, lon, distance interface{}
+	if res.server.ID != "" {
+		lat, lon, distance = res.server.Lat, res.server.Lon, res.server.Distance
+	}
+
+	var clientLat, clientLon interface{}
+	if res.client.IP != "" {
+		clientLat, clientLon = res.client.Lat, res.client.Lon
+	}
+
+	_, err := h.insert.Exec(
+		res.timestamp.Unix(), res.duration.Seconds(), res.status(), res.failedPhase, errText,
+		nullFloat(res.latency), nullFloat(res.download), nullFloat(res.upload),
+		res.server.ID, res.server.Name, res.server.Sponsor, res.server.URL, res.server.Country, res.server.CC,
+		lat, lon, distance, res.client.IP, res.client.Isp, clientLat, clientLon, nullFloat(res.anomaly),
+	)
+	if err != nil {
+		return err
+	}
+
+	return h.prune(res.timestamp)
+}
+
+// prune deletes the results older than the retention period
+func (h *historyStore) prune(now time.Time) error {
+	if h.retention <= 0 {
+		return nil
+	}
+
+	_, err := h.db.Exec(`DELETE FROM results WHERE timestamp < ?`, now.Add(-h.retention).Unix())
+	return err
+}
+
+// results reads back the results recorded between since and until, oldest first
+func (h *historyStore) results(since time.Time, until time.Time) ([]results, error) {
+	rows, err := h.db.Query(`SELECT
+		timestamp, duration_seconds, failed_phase, error, latency, download, upload,
+		server_id, server_name, server_sponsor, server_url, server_country, server_cc,
+		server_lat, server_lon, server_distance, client_ip, client_isp, client_lat, client_lon, anomaly_score
+		FROM results WHERE timestamp >= ? AND timestamp < ? ORDER BY timestamp, id`, since.Unix(), until.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []results
+	for rows.Next() {
+		var res results
+		var timestamp int64
+		var duration float64
+		var errText string
+		var latency, download, upload, lat, lon, distance, clientLat, clientLon, anomaly sql.NullFloat64
+
+		err = rows.Scan(
+			&timestamp, &duration, &res.failedPhase, &errText, &latency, &download, &upload,
+			&res.server.ID, &res.server.Name, &res.server.Sponsor, &res.server.URL, &res.server.Country, &res.server.CC,
+			&lat, &lon, &distance, &res.client.IP, &res.client.Isp, &clientLat, &clientLon, &anomaly,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		res.timestamp = time.Unix(timestamp, 0)
+		res.duration = time.Duration(duration * float64(time.Second))
+		if errText != "" {
+			res.err = errors.New(errText)
+		}
+		res.latency, res.download, res.upload = floatFromNull(latency), floatFromNull(download), floatFromNull(upload)
+		res.anomaly = floatFromNull(anomaly)
+		res.server.Lat, res.server.Lon, res.server.Distance = lat.Float64, lon.Float64, distance.Float64
+		res.client.Lat, res.client.Lon = clientLat.Float64, clientLon.Float64
+		if res.latency != nil {
+			res.server.Latency = *res.latency
+		}
+
+		all = append(all, res)
+	}
+
+	return all, rows.Err()
+}
+
+func (h *historyStore) Close() error {
+	h.insert.Close()
+	return h.db.Close()
+}
+
+func nullFloat(f *float64) interface{} {
+	if f == nil {
+		return nil
+	}
+
+	return *f
+}
+
+func floatFromNull(f sql.NullFloat64) *float64 {
+	if !f.Valid {
+		return nil
+	}
+
+	return &f.Float64
+}
+
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "Write the results recorded in the SQLite history to stdout as JSON lines",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "days",
+			Value: 30,
+			Usage: "The number of days of history to export",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.GlobalString("sqlite-path") == "" {
+			return cli.NewExitError("--sqlite-path is required to export history", 1)
+		}
+
+		// keep the log lines out of the exported results
+		log.SetOutput(os.Stderr)
+
+		h, err := openHistory(c.GlobalString("sqlite-path"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer h.Close()
+
+		now := time.Now()
+		all, err := h.results(now.AddDate(0, 0, -c.Int("days")), now.Add(time.Second))
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("error reading history: %v", err), 1)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		for _, res := range all {
+			err = enc.Encode(resultJSON(res))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
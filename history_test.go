@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testHistory(t *testing.T) (*historyStore, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := openHistory(filepath.Join(dir, "history.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return h, func() {
+		h.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_historyStore_roundTrip(t *testing.T) {
+	h, cleanup := testHistory(t)
+	defer cleanup()
+
+	at := time.Unix(1500000000, 0)
+	ok := results{
+		server:    testServer,
+		client:    testClient,
+		latency:   floatPtr(9.5),
+		download:  floatPtr(94.2),
+		upload:    floatPtr(11.7),
+		timestamp: at,
+		duration:  42 * time.Second,
+		anomaly:   floatPtr(1.5),
+	}
+	failed := results{
+		failedPhase: phaseConfig,
+		err:         errors.New("no route to host"),
+		timestamp:   at.Add(time.Hour),
+		duration:    time.Second,
+	}
+
+	for _, res := range []results{failed, ok} {
+		if err := h.WriteResult(res); err != nil {
+			t.Fatalf("WriteResult() error = %v", err)
+		}
+	}
+
+	got, err := h.results(at, at.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("results() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("results() returned %d results, want 2", len(got))
+	}
+
+	if !reflect.DeepEqual(resultJSON(got[0]), resultJSON(ok)) {
+		t.Errorf("results()[0] = %v, want %v", resultJSON(got[0]), resultJSON(ok))
+	}
+	if got[0].server != testServer {
+		t.Errorf("results()[0].server = %+v, want %+v", got[0].server, testServer)
+	}
+	if got[0].client != testClient {
+		t.Errorf("results()[0].client = %+v, want %+v", got[0].client, testClient)
+	}
+	if !reflect.DeepEqual(resultJSON(got[1]), resultJSON(failed)) {
+		t.Errorf("results()[1] = %v, want %v", resultJSON(got[1]), resultJSON(failed))
+	}
+
+	got, err = h.results(at.Add(time.Minute), at.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("results() error = %v", err)
+	}
+	if len(got) != 1 || got[0].status() != statusFailed {
+		t.Errorf("results() since = %v, want only the failed result", got)
+	}
+}
+
+func Test_historyStore_prune(t *testing.T) {
+	h, cleanup := testHistory(t)
+	defer cleanup()
+	h.retention = 24 * time.Hour
+
+	now := time.Unix(1500000000, 0)
+	for _, at := range []time.Time{now.Add(-48 * time.Hour), now.Add(-time.Hour), now} {
+		if err := h.WriteResult(results{timestamp: at}); err != nil {
+			t.Fatalf("WriteResult() error = %v", err)
+		}
+	}
+
+	got, err := h.results(time.Unix(0, 0), now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("results() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("results() returned %d results after pruning, want 2", len(got))
+	}
+}
+
+func Test_migrateHistory(t *testing.T) {
+	h, cleanup := testHistory(t)
+	defer cleanup()
+
+	// migrating an up to date database is a no-op
+	if err := migrateHistory(h.db); err != nil {
+		t.Fatalf("migrateHistory() error = %v", err)
+	}
+
+	var applied int
+	err := h.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(historyMigrations) {
+		t.Errorf("schema_migrations has %d rows, want %d", applied, len(historyMigrations))
+	}
+}
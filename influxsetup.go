@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+type retentionPolicy struct {
+	name        string
+	duration    string
+	replication int
+	makeDefault bool
+}
+
+// pingInfluxDB checks the server can be reached before anything is written
+func pingInfluxDB(c client.Client) error {
+	_, _, err := c.Ping(5 * time.Second)
+	if err != nil {
+		return fmt.Errorf("couldn't reach influxdb: %v", err)
+	}
+
+	return nil
+}
+
+// setupInfluxDB creates the database and retention policy when they are
+// missing, it needs the v1 HTTP API as the other clients can't query
+func setupInfluxDB(c client.Client, database string, rp retentionPolicy) error {
+	if database == "" {
+		return nil
+	}
+
+	exists, err := influxNameExists(c, "SHOW DATABASES", "", database)
+	if err != nil {
+		return fmt.Errorf("couldn't list influxdb databases: %v", err)
+	}
+
+	if !exists {
+		log.Printf("creating influxdb database %q", database)
+		err = influxExec(c, fmt.Sprintf("CREATE DATABASE %s", quoteIdent(database)), "")
+		if err != nil {
+			return fmt.Errorf("couldn't create influxdb database %q: %v", database, err)
+		}
+	}
+
+	if rp.name == "" {
+		return nil
+	}
+
+	exists, err = influxNameExists(c, fmt.Sprintf("SHOW RETENTION POLICIES ON %s", quoteIdent(database)), database, rp.name)
+	if err != nil {
+		return fmt.Errorf("couldn't list influxdb retention policies: %v", err)
+	}
+
+	if exists {
+		return nil
+	}
+
+	log.Printf("creating influxdb retention policy %q on %q", rp.name, database)
+	err = influxExec(c, rp.createStatement(database), database)
+	if err != nil {
+		return fmt.Errorf("couldn't create influxdb retention policy %q: %v", rp.name, err)
+	}
+
+	return nil
+}
+
+func (rp retentionPolicy) createStatement(database string) string {
+	stmt := fmt.Sprintf("CREATE RETENTION POLICY %s ON %s DURATION %s REPLICATION %d",
+		quoteIdent(rp.name), quoteIdent(database), rp.duration, rp.replication)
+	if rp.makeDefault {
+		stmt += " DEFAULT"
+	}
+
+	return stmt
+}
+
+// influxNameExists runs a SHOW statement and looks for name in the first
+// column of its results
+func influxNameExists(c client.Client, stmt string, database string, name string) (bool, error) {
+	resp, err := c.Query(client.NewQuery(stmt, database, ""))
+	if err != nil {
+		return false, err
+	}
+	if resp.Error() != nil {
+		return false, resp.Error()
+	}
+
+	for _, result := range resp.Results {
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				if len(values) > 0 && values[0] == name {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func influxExec(c client.Client, stmt string, database string) error {
+	resp, err := c.Query(client.NewQuery(stmt, database, ""))
+	if err != nil {
+		return err
+	}
+
+	return resp.Error()
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `\"`, -1) + `"`
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+func showResponse(names ...string) *client.Response {
+	row := models.Row{Columns: []string{"name"}}
+	for _, name := range names {
+		row.Values = append(row.Values, []interface{}{name})
+	}
+
+	return &client.Response{Results: []client.Result{{Series: []models.Row{row}}}}
+}
+
+func Test_setupInfluxDB(t *testing.T) {
+	tests := []struct {
+		name        string
+		database    string
+		rp          retentionPolicy
+		responses   map[string]*client.Response
+		wantQueries []string
+	}{
+		{
+			name:     "everything exists",
+			database: "speedtest",
+			rp:       retentionPolicy{name: "month", duration: "30d", replication: 1},
+			responses: map[string]*client.Response{
+				"SHOW DATABASES":                         showResponse("_internal", "speedtest"),
+				`SHOW RETENTION POLICIES ON "speedtest"`: showResponse("autogen", "month"),
+			},
+			wantQueries: []string{
+				"SHOW DATABASES",
+				`SHOW RETENTION POLICIES ON "speedtest"`,
+			},
+		},
+		{
+			name:     "database and retention policy missing",
+			database: "speedtest",
+			rp:       retentionPolicy{name: "month", duration: "30d", replication: 1, makeDefault: true},
+			responses: map[string]*client.Response{
+				"SHOW DATABASES": showResponse("_internal"),
+			},
+			wantQueries: []string{
+				"SHOW DATABASES",
+				`CREATE DATABASE "speedtest"`,
+				`SHOW RETENTION POLICIES ON "speedtest"`,
+				`CREATE RETENTION POLICY "month" ON "speedtest" DURATION 30d REPLICATION 1 DEFAULT`,
+			},
+		},
+		{
+			name:     "no retention policy configured",
+			database: "speedtest",
+			responses: map[string]*client.Response{
+				"SHOW DATABASES": showResponse("speedtest"),
+			},
+			wantQueries: []string{"SHOW DATABASES"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fakeInfluxClient{responses: tt.responses}
+			if err := setupInfluxDB(c, tt.database, tt.rp); err != nil {
+				t.Fatalf("setupInfluxDB() error = %v", err)
+			}
+			if !reflect.DeepEqual(c.queries, tt.wantQueries) {
+				t.Errorf("setupInfluxDB() queries = %q, want %q", c.queries, tt.wantQueries)
+			}
+		})
+	}
+}
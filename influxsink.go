@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/urfave/cli"
+)
+
+// influxPasswordFlag is misspelled, but it's the name users already pass
+const influxPasswordFlag = "influxPasword"
+
+var influxFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "influxUsername, u",
+		Usage: "The username for the influxDB instance",
+	},
+	cli.StringFlag{
+		Name:  influxPasswordFlag + ", p",
+		Usage: "The password for the influxDB instance",
+	},
+	cli.StringFlag{
+		Name:  "influxDB, db",
+		Usage: "The name for the influxDB database, results are only written to influxDB when this, --influx-bucket or the udp transport is set",
+	},
+	cli.StringFlag{
+		Name:  "influxURL, url",
+		Value: "http://localhost:8086",
+		Usage: "The name for the influxDB database",
+	},
+	cli.StringFlag{
+		Name:  "influx-api",
+		Value: "v1",
+		Usage: "The influxDB write API to use, v1 (/write) or v2 (/api/v2/write, also served by InfluxDB 3)",
+	},
+	cli.StringFlag{
+		Name:  "influx-org",
+		Usage: "The organization to write to with the v2 API",
+	},
+	cli.StringFlag{
+		Name:  "influx-bucket",
+		Usage: "The bucket to write to with the v2 API",
+	},
+	cli.StringFlag{
+		Name:   "influx-token",
+		Usage:  "The API token for the v2 API",
+		EnvVar: "INFLUX_TOKEN",
+	},
+	cli.StringFlag{
+		Name:  "influx-transport",
+		Value: "http",
+		Usage: "The transport to write to influxDB with, http or udp",
+	},
+	cli.StringFlag{
+		Name:  "influx-udp-addr",
+		Value: "localhost:8089",
+		Usage: "The host:port of the influxDB UDP listener",
+	},
+	cli.IntFlag{
+		Name:  "influx-udp-payload-size",
+		Value: client.UDPPayloadSize,
+		Usage: "The maximum size in bytes of a UDP packet sent to influxDB",
+	},
+	cli.BoolTFlag{
+		Name:  "influx-create-db",
+		Usage: "Create the influxDB database on startup if it doesn't exist (v1 HTTP API only)",
+	},
+	cli.StringFlag{
+		Name:  "influx-retention-policy",
+		Usage: "The retention policy to write into, created on startup if it doesn't exist (v1 HTTP API only)",
+	},
+	cli.StringFlag{
+		Name:  "influx-retention-duration",
+		Value: "INF",
+		Usage: "The duration of a created retention policy, e.g. 30d or INF",
+	},
+	cli.IntFlag{
+		Name:  "influx-retention-replication",
+		Value: 1,
+		Usage: "The replication factor of a created retention policy",
+	},
+	cli.BoolFlag{
+		Name:  "influx-retention-default",
+		Usage: "Make a created retention policy the database default",
+	},
+	cli.IntFlag{
+		Name:  "write-retries",
+		Value: 3,
+		Usage: "The number of times to retry a failed influxDB write, 0 disables retrying",
+	},
+	cli.IntFlag{
+		Name:  "write-retry-initial",
+		Value: 1,
+		Usage: "The amount of time in seconds to wait before the first retry, doubled each retry",
+	},
+	cli.IntFlag{
+		Name:  "write-retry-max-elapsed",
+		Value: 60,
+		Usage: "The amount of time in seconds after which a write stops being retried",
+	},
+	cli.StringFlag{
+		Name:  "spool-dir",
+		Usage: "Save batches that fail to write to this directory and replay them once influxDB is back, which also lets the daemon start while influxDB is down, disabled when empty",
+	},
+	cli.IntFlag{
+		Name:  "spool-max-size",
+		Value: 100,
+		Usage: "The size in megabytes the spool can grow to before the oldest batches are dropped",
+	},
+	cli.IntFlag{
+		Name:  "spool-max-age",
+		Value: 168,
+		Usage: "The age in hours after which spooled batches are dropped",
+	},
+}
+
+// influxSink writes results and events to influxDB, through the retrying and
+// spooling clients when they're configured
+type influxSink struct {
+	db       client.Client
+	stats    client.Client
+	database string
+	rp       string
+	retrier  *retryingClient
+	spool    *spoolingClient
+
+	// when influxDB is down at startup the database and retention policy
+	// setup waits for it, retried on a backoff rather than every write
+	createDB      bool
+	policy        retentionPolicy
+	setupPending  bool
+	setupAttempts int
+	nextSetup     time.Time
+	now           func() time.Time
+}
+
+func newInfluxSink(c *cli.Context) (sink, error) {
+	if !influxConfigured(c) {
+		return nil, nil
+	}
+
+	db, err := newInfluxClient(c)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to influxdb: %v", err)
+	}
+
+	s := &influxSink{
+		stats:    db,
+		database: c.String("influxDB"),
+		rp:       c.String("influx-retention-policy"),
+		createDB: c.String("influx-transport") != "udp" && c.String("influx-api") != "v2" && c.BoolT("influx-create-db"),
+		now:      time.Now,
+	}
+	s.policy = retentionPolicy{
+		name:        s.rp,
+		duration:    c.String("influx-retention-duration"),
+		replication: c.Int("influx-retention-replication"),
+		makeDefault: c.Bool("influx-retention-default"),
+	}
+
+	// an unreachable server stops startup, unless there's a spool to hold
+	// the results until it's back
+	err = pingInfluxDB(db)
+	switch {
+	case err != nil && c.String("spool-dir") == "":
+		db.Close()
+		return nil, fmt.Errorf("%v, set --spool-dir to start anyway and hold results until it's back", err)
+	case err != nil:
+		log.Printf("%v, spooling results until it's back", err)
+		s.setupPending = true
+	case s.createDB:
+		err = setupInfluxDB(db, s.database, s.policy)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%v, set --influx-create-db=false if the user can't manage databases", err)
+		}
+	}
+
+	// stats are written with the raw client, they aren't worth retrying or
+	// spooling
+	s.retrier = newRetryingClient(db, c.Int("write-retries")+1, time.Duration(c.Int("write-retry-initial"))*time.Second, time.Duration(c.Int("write-retry-max-elapsed"))*time.Second)
+	s.db = s.retrier
+
+	if c.String("spool-dir") != "" {
+		s.spool, err = newSpoolingClient(s.db, c.String("spool-dir"), int64(c.Int("spool-max-size"))<<20, time.Duration(c.Int("spool-max-age"))*time.Hour)
+		if err != nil {
+			return nil, fmt.Errorf("error opening spool: %v", err)
+		}
+		s.db = s.spool
+	}
+
+	return s, nil
+}
+
+// influxConfigured reports whether influxDB has been given somewhere to
+// write, like the other sinks it's off until then
+func influxConfigured(c *cli.Context) bool {
+	return c.String("influxDB") != "" || c.String("influx-bucket") != "" || c.String("influx-transport") == "udp"
+}
+
+// newInfluxClient picks the influxDB client for the configured transport and API
+func newInfluxClient(c *cli.Context) (client.Client, error) {
+	switch c.String("influx-transport") {
+	case "http":
+	case "udp":
+		return influxDBUDPClient(c.String("influx-udp-addr"), c.Int("influx-udp-payload-size"))
+	default:
+		return nil, fmt.Errorf("unsupported influxdb transport %q, use http or udp", c.String("influx-transport"))
+	}
+
+	switch c.String("influx-api") {
+	case "v1":
+		return influxDBClient(c.String("influxURL"), c.String("influxUsername"), c.String(influxPasswordFlag))
+	case "v2":
+		return influxDBV2Client(c.String("influxURL"), c.String("influx-org"), c.String("influx-bucket"), c.String("influx-token"))
+	default:
+		return nil, fmt.Errorf("unsupported influxdb api %q, use v1 or v2", c.String("influx-api"))
+	}
+}
+
+// ensureSetup pings influxDB when it was down at startup, backing off
+// between attempts, and runs the setup once it's back. A setup failure then
+// is logged rather than retried, it won't fix itself.
+func (s *influxSink) ensureSetup() {
+	if !s.setupPending || s.now().Before(s.nextSetup) {
+		return
+	}
+
+	err := pingInfluxDB(s.stats)
+	if err != nil {
+		s.setupAttempts++
+		s.nextSetup = s.now().Add(backoff(time.Minute, s.setupAttempts))
+		return
+	}
+
+	s.setupPending = false
+	if !s.createDB {
+		return
+	}
+
+	log.Printf("influxdb is back, checking the database and retention policy")
+	err = setupInfluxDB(s.stats, s.database, s.policy)
+	if err != nil {
+		log.Printf("error setting up influxdb, not retrying: %v", err)
+	}
+}
+
+func (s *influxSink) Name() string {
+	return "influxdb"
+}
+
+func (s *influxSink) WriteResult(res results) error {
+	s.ensureSetup()
+
+	err := writeMetrics(s.db, s.database, s.rp, res)
+	if err != nil {
+		return err
+	}
+
+	writeStats(s.stats, s.database, s.rp, "speedtest_writes", s.retrier.Stats().fields())
+	if s.spool != nil {
+		writeStats(s.stats, s.database, s.rp, "speedtest_spool", s.spool.Stats().fields())
+	}
+
+	return nil
+}
+
+func (s *influxSink) WriteEvent(ev event) error {
+	s.ensureSetup()
+
+	bp, err := client.NewBatchPoints(
+		client.BatchPointsConfig{
+			Database:        s.database,
+			RetentionPolicy: s.rp,
+			Precision:       "s",
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	point, err := client.NewPoint(ev.name, ev.tags, ev.fields, ev.at)
+	if err != nil {
+		return err
+	}
+
+	bp.AddPoint(point)
+
+	err = s.db.Write(bp)
+	return err
+}
+
+func (s *influxSink) Close() error {
+	return s.stats.Close()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// testContext parses args against flags the way the app would
+func testContext(t *testing.T, flags []cli.Flag, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range flags {
+		f.Apply(set)
+	}
+
+	err := set.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cli.NewContext(nil, set, nil)
+}
+
+func Test_newInfluxClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{
+			name: "v1",
+			args: []string{"--influx-api", "v1"},
+		},
+		{
+			name: "v2",
+			args: []string{"--influx-api", "v2", "--influx-bucket", "speedtest"},
+		},
+		{
+			name:    "unsupported api",
+			args:    []string{"--influx-api", "v3"},
+			wantErr: `unsupported influxdb api "v3"`,
+		},
+		{
+			name: "udp",
+			args: []string{"--influx-transport", "udp"},
+		},
+		{
+			name:    "unsupported transport",
+			args:    []string{"--influx-transport", "tcp"},
+			wantErr: `unsupported influxdb transport "tcp"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := newInfluxClient(testContext(t, influxFlags, tt.args...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newInfluxClient() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newInfluxClient() error = %v", err)
+			}
+			db.Close()
+		})
+	}
+}
+
+func Test_influxSink_deferredSetup(t *testing.T) {
+	db := &fakeInfluxClient{pingErr: errors.New("connection refused")}
+	now := time.Unix(1500000000, 0)
+	s := &influxSink{
+		db:           db,
+		stats:        db,
+		database:     "speedtest",
+		retrier:      newRetryingClient(db, 1, time.Second, time.Minute),
+		createDB:     true,
+		setupPending: true,
+		now:          func() time.Time { return now },
+	}
+	res := results{server: testServer, latency: floatPtr(9.5), timestamp: now}
+
+	// influxDB being down doesn't stop the write being attempted, and the
+	// setup isn't retried before its backoff is up
+	s.WriteResult(res)
+	s.WriteResult(res)
+	if db.pings != 1 || len(db.queries) != 0 || !s.setupPending {
+		t.Fatalf("pings = %d, queries = %q while influxdb was down, want one ping", db.pings, db.queries)
+	}
+	if len(db.writes) == 0 {
+		t.Fatalf("the result wasn't written while setup was pending")
+	}
+
+	db.pingErr = nil
+	now = now.Add(time.Hour)
+	s.WriteEvent(event{name: "speedtest_outage", fields: map[string]interface{}{"downtime_seconds": 0.0}, at: now})
+	if s.setupPending || len(db.queries) == 0 {
+		t.Fatalf("setup wasn't retried once influxdb was back, queries = %q", db.queries)
+	}
+
+	queries := len(db.queries)
+	s.WriteResult(res)
+	if db.pings != 2 || len(db.queries) != queries {
+		t.Errorf("setup ran again after it succeeded, pings = %d, queries = %q", db.pings, db.queries)
+	}
+}
+
+func Test_newInfluxSink(t *testing.T) {
+	spool, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    bool
+		wantErr string
+	}{
+		{
+			name: "not configured",
+			args: []string{"--sqlite-path", "history.db"},
+		},
+		{
+			name:    "unreachable",
+			args:    []string{"--influxDB", "speedtest", "--influxURL", "http://127.0.0.1:1"},
+			wantErr: "couldn't reach influxdb",
+		},
+		{
+			name: "unreachable with a spool",
+			args: []string{"--influxDB", "speedtest", "--influxURL", "http://127.0.0.1:1", "--spool-dir", spool},
+			want: true,
+		},
+		{
+			name: "v2 bucket with a spool",
+			args: []string{"--influx-api", "v2", "--influx-bucket", "speedtest", "--influxURL", "http://127.0.0.1:1", "--spool-dir", spool},
+			want: true,
+		},
+		{
+			name: "udp",
+			args: []string{"--influx-transport", "udp", "--influx-udp-addr", "127.0.0.1:8089"},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newInfluxSink(testContext(t, append(influxFlags, historyFlags...), tt.args...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newInfluxSink() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newInfluxSink() error = %v", err)
+			}
+			if got := s != nil; got != tt.want {
+				t.Errorf("newInfluxSink() enabled = %v, want %v", got, tt.want)
+			}
+			if s != nil {
+				s.Close()
+			}
+		})
+	}
+}
+
+func Test_newInfluxClient_password(t *testing.T) {
+	var user, password string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ = r.BasicAuth()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	db, err := newInfluxClient(testContext(t, influxFlags, "--influxURL", srv.URL, "--influxUsername", "speedtest", "--influxPasword", "hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, _, err = db.Ping(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if user != "speedtest" || password != "hunter2" {
+		t.Errorf("basic auth = %q:%q, want speedtest:hunter2", user, password)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// influxV2Client writes through the InfluxDB 2.x /api/v2/write endpoint,
+// which InfluxDB 3.x also serves. It satisfies client.Client so the points
+// built by writeMetrics are written unchanged, the batch database is ignored
+// in favour of the configured bucket.
+type influxV2Client struct {
+	url        url.URL
+	org        string
+	bucket     string
+	token      string
+	httpClient *http.Client
+}
+
+func influxDBV2Client(addr string, org string, bucket string, token string) (client.Client, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported protocol scheme %q, the influxdb url must start with http:// or https://", u.Scheme)
+	}
+
+	if bucket == "" {
+		return nil, errors.New("an influxdb bucket is required for the v2 write api")
+	}
+
+	return &influxV2Client{
+		url:        *u,
+		org:        org,
+		bucket:     bucket,
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (c *influxV2Client) newRequest(method string, endpoint string, body *bytes.Buffer) (*http.Request, error) {
+	u := c.url
+	u.Path = path.Join(u.Path, endpoint)
+
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequest(method, u.String(), body)
+	} else {
+		req, err = http.NewRequest(method, u.String(), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", "speedtest-to-influxdb")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Token "+c.token)
+	}
+
+	return req, nil
+}
+
+// Ping checks the server is up, the timeout is unused as v2 has no leader to wait for
+func (c *influxV2Client) Ping(timeout time.Duration) (time.Duration, string, error) {
+	now := time.Now()
+
+	req, err := c.newRequest("GET", "ping", nil)
+	if err != nil {
+		return 0, "", err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return 0, "", influxV2Error(resp)
+	}
+
+	return time.Since(now), resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+func (c *influxV2Client) Write(bp client.BatchPoints) error {
+	var b bytes.Buffer
+
+	for _, p := range bp.Points() {
+		b.WriteString(p.PrecisionString(bp.Precision()))
+		b.WriteByte('\n')
+	}
+
+	req, err := c.newRequest("POST", "api/v2/write", &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	params := req.URL.Query()
+	params.Set("org", c.org)
+	params.Set("bucket", c.bucket)
+	params.Set("precision", bp.Precision())
+	req.URL.RawQuery = params.Encode()
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return influxV2Error(resp)
+	}
+
+	return nil
+}
+
+// Query isn't supported, v2 servers are queried with Flux rather than InfluxQL
+func (c *influxV2Client) Query(q client.Query) (*client.Response, error) {
+	return nil, errors.New("querying is not supported by the influxdb v2 client")
+}
+
+func (c *influxV2Client) Close() error {
+	return nil
+}
+
+// influxV2Error turns an error response into an error, using the message from
+// the JSON body when there is one
+func influxV2Error(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var msg struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &msg) == nil && msg.Message != "" {
+		return &influxHTTPError{statusCode: resp.StatusCode, message: msg.Message}
+	}
+
+	return &influxHTTPError{statusCode: resp.StatusCode, message: string(bytes.TrimSpace(body))}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func Test_influxV2Client_Write(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{
+			name:   "accepted",
+			status: http.StatusNoContent,
+		},
+		{
+			name:    "unauthorized",
+			status:  http.StatusUnauthorized,
+			body:    `{"code":"unauthorized","message":"unauthorized access"}`,
+			wantErr: "401 Unauthorized: unauthorized access",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotReq *http.Request
+			var gotBody string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				gotReq, gotBody = r, string(b)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			c, err := influxDBV2Client(srv.URL, "home", "network", "s3cret")
+			if err != nil {
+				t.Fatalf("influxDBV2Client() error = %v", err)
+			}
+
+			bp, _ := client.NewBatchPoints(client.BatchPointsConfig{Precision: "s"})
+			p, _ := client.NewPoint("speedtest", map[string]string{"status": statusOK}, map[string]interface{}{"download": 100.0}, time.Unix(1525500000, 0))
+			bp.AddPoint(p)
+
+			err = c.Write(bp)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("influxV2Client.Write() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("influxV2Client.Write() error = %v", err)
+			}
+
+			if gotReq.URL.Path != "/api/v2/write" {
+				t.Errorf("path = %v, want /api/v2/write", gotReq.URL.Path)
+			}
+			if q := gotReq.URL.Query(); q.Get("org") != "home" || q.Get("bucket") != "network" || q.Get("precision") != "s" {
+				t.Errorf("query = %v, want org, bucket and precision set", q)
+			}
+			if auth := gotReq.Header.Get("Authorization"); auth != "Token s3cret" {
+				t.Errorf("Authorization = %v, want Token s3cret", auth)
+			}
+			if want := "speedtest,status=ok download=100 1525500000"; strings.TrimSpace(gotBody) != want {
+				t.Errorf("body = %q, want %q", gotBody, want)
+			}
+		})
+	}
+}
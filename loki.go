@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var lokiFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "loki-url",
+		Usage: "Push result and event logs to this loki URL, disabled when empty",
+	},
+	cli.StringFlag{
+		Name:  "loki-labels",
+		Value: "job=speedtest",
+		Usage: "Static labels added to every stream, as comma separated key=value pairs",
+	},
+	cli.StringFlag{
+		Name:  "loki-tenant-id",
+		Usage: "The tenant to push as, sent as X-Scope-OrgID",
+	},
+	cli.StringFlag{
+		Name:  "loki-username",
+		Usage: "The username for loki basic auth",
+	},
+	cli.StringFlag{
+		Name:   "loki-password",
+		Usage:  "The password for loki basic auth",
+		EnvVar: "LOKI_PASSWORD",
+	},
+	cli.StringFlag{
+		Name:   "loki-bearer-token",
+		Usage:  "The bearer token for loki auth, used instead of basic auth",
+		EnvVar: "LOKI_BEARER_TOKEN",
+	},
+}
+
+// lokiLabelName is what loki accepts as a label name
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// lokiSink pushes each result and event as a JSON log line, labelled so they
+// can be selected without parsing the line
+type lokiSink struct {
+	url         string
+	labels      map[string]string
+	tenantID    string
+	username    string
+	password    string
+	bearerToken string
+	httpClient  *http.Client
+}
+
+func newLokiSink(c *cli.Context) (sink, error) {
+	if c.String("loki-url") == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(c.String("loki-url"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid loki url: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported loki url scheme %q", u.Scheme)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/loki/api/v1/push"
+	}
+
+	labels, err := parseKeyValues(c.String("loki-labels"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid loki labels: %v", err)
+	}
+	for name := range labels {
+		if !lokiLabelName.MatchString(name) {
+			return nil, fmt.Errorf("invalid loki label name %q", name)
+		}
+	}
+
+	return &lokiSink{
+		url:         u.String(),
+		labels:      labels,
+		tenantID:    c.String("loki-tenant-id"),
+		username:    c.String("loki-username"),
+		password:    c.String("loki-password"),
+		bearerToken: c.String("loki-bearer-token"),
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *lokiSink) Name() string {
+	return "loki"
+}
+
+// lokiStream is one entry of a push request
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (s *lokiSink) WriteResult(res results) error {
+	labels := s.streamLabels("result")
+	labels["status"] = res.status()
+	if res.server.ID != "" {
+		labels["server_id"] = res.server.ID
+		labels["server_country"] = res.server.Country
+	}
+
+	line := resultJSON(res)
+	line["level"] = resultLevel(res)
+
+	return s.push(labels, res.timestamp, line)
+}
+
+func (s *lokiSink) WriteEvent(ev event) error {
+	labels := s.streamLabels("event")
+	labels["name"] = ev.name
+	for k, v := range ev.tags {
+		labels[k] = v
+	}
+
+	line := map[string]interface{}{
+		"timestamp": ev.at.UTC().Format(time.RFC3339),
+		"name":      ev.name,
+	}
+	for k, v := range ev.tags {
+		line[k] = v
+	}
+	for k, v := range ev.fields {
+		line[k] = v
+	}
+
+	return s.push(labels, ev.at, line)
+}
+
+// resultLevel is the log level of a result, so failures stand out
+func resultLevel(res results) string {
+	switch res.status() {
+	case statusOK:
+		return "info"
+	case statusPartial:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// streamLabels starts from the static labels
+func (s *lokiSink) streamLabels(kind string) map[string]string {
+	labels := map[string]string{"kind": kind}
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+
+	return labels
+}
+
+func (s *lokiSink) push(labels map[string]string, at time.Time, line map[string]interface{}) error {
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	text, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string][]lokiStream{
+		"streams": {{
+			Stream: labels,
+			Values: [][2]string{{strconv.FormatInt(at.UnixNano(), 10), string(text)}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "speedtest-to-influxdb")
+	if s.tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.tenantID)
+	}
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearerToken)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("loki returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+func (s *lokiSink) Close() error {
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_lokiSink(t *testing.T) {
+	at := time.Unix(1500000000, 0)
+	tests := []struct {
+		name       string
+		write      func(s *lokiSink) error
+		wantLabels map[string]string
+		wantLine   map[string]interface{}
+	}{
+		{
+			name: "failed result",
+			write: func(s *lokiSink) error {
+				return s.WriteResult(results{
+					server:      testServer,
+					latency:     floatPtr(9.5),
+					failedPhase: phaseDownload,
+					err:         errors.New("connection reset"),
+					timestamp:   at,
+				})
+			},
+			wantLabels: map[string]string{"job": "speedtest", "kind": "result", "status": "partial", "server_id": "1234", "server_country": "United States"},
+			wantLine: map[string]interface{}{
+				"level":            "warning",
+				"timestamp":        "2017-07-14T02:40:00Z",
+				"duration_seconds": 0.0,
+				"status":           "partial",
+				"failed_phase":     "download",
+				"error":            "connection reset",
+				"latency":          9.5,
+				"server_id":        "1234",
+				"server_name":      "Springfield",
+				"server_sponsor":   "Example ISP",
+				"server_url":       "http://speedtest.example.com/speedtest/upload.php",
+				"server_country":   "United States",
+				"server_distance":  12.5,
+			},
+		},
+		{
+			name: "outage event",
+			write: func(s *lokiSink) error {
+				return s.WriteEvent(outageEvent{kind: outageStart, start: at}.event())
+			},
+			wantLabels: map[string]string{"job": "speedtest", "kind": "event", "name": "speedtest_outage", "event": "start"},
+			wantLine: map[string]interface{}{
+				"timestamp":        "2017-07-14T02:40:00Z",
+				"name":             "speedtest_outage",
+				"event":            "start",
+				"duration_seconds": 0.0,
+				"downtime_seconds": 0.0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("X-Scope-OrgID"); got != "home" {
+					t.Errorf("X-Scope-OrgID = %q, want %q", got, "home")
+				}
+
+				var push struct {
+					Streams []lokiStream
+				}
+				if err := json.NewDecoder(r.Body).Decode(&push); err != nil || len(push.Streams) != 1 {
+					t.Fatalf("push = %+v, %v, want one stream", push, err)
+				}
+
+				stream := push.Streams[0]
+				if !reflect.DeepEqual(stream.Stream, tt.wantLabels) {
+					t.Errorf("labels = %v, want %v", stream.Stream, tt.wantLabels)
+				}
+				if stream.Values[0][0] != "1500000000000000000" {
+					t.Errorf("timestamp = %s, want 1500000000000000000", stream.Values[0][0])
+				}
+
+				var line map[string]interface{}
+				json.Unmarshal([]byte(stream.Values[0][1]), &line)
+				if !reflect.DeepEqual(line, tt.wantLine) {
+					t.Errorf("line = %v, want %v", line, tt.wantLine)
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			s := &lokiSink{
+				url:        srv.URL,
+				labels:     map[string]string{"job": "speedtest"},
+				tenantID:   "home",
+				httpClient: srv.Client(),
+			}
+			if err := tt.write(s); err != nil {
+				t.Errorf("write error = %v", err)
+			}
+		})
+	}
+}
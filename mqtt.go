@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var mqttFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "mqtt-broker",
+		Usage: "Publish results to this MQTT broker, e.g. tcp://localhost:1883 or ssl://broker:8883, disabled when empty",
+	},
+	cli.StringFlag{
+		Name:  "mqtt-topic",
+		Value: "speedtest/result",
+		Usage: "The topic results are published to as JSON",
+	},
+	cli.IntFlag{
+		Name:  "mqtt-qos",
+		Usage: "The QoS to publish with, 0 or 1",
+	},
+	cli.BoolFlag{
+		Name:  "mqtt-retain",
+		Usage: "Publish results with the retain flag set",
+	},
+	cli.StringFlag{
+		Name:  "mqtt-client-id",
+		Value: "speedtest-to-influxdb",
+		Usage: "The client ID to connect to the broker with",
+	},
+	cli.StringFlag{
+		Name:  "mqtt-username",
+		Usage: "The username for the MQTT broker",
+	},
+	cli.StringFlag{
+		Name:   "mqtt-password",
+		Usage:  "The password for the MQTT broker",
+		EnvVar: "MQTT_PASSWORD",
+	},
+	cli.StringFlag{
+		Name:  "mqtt-ca-file",
+		Usage: "A PEM file of CA certificates to verify the broker with, for ssl:// brokers",
+	},
+	cli.BoolFlag{
+		Name:  "mqtt-insecure-skip-verify",
+		Usage: "Don't verify the broker certificate, for ssl:// brokers",
+	},
+	cli.BoolFlag{
+		Name:  "mqtt-ha-discovery",
+		Usage: "Publish Home Assistant MQTT discovery configs for the result sensors",
+	},
+	cli.StringFlag{
+		Name:  "mqtt-ha-prefix",
+		Value: "homeassistant",
+		Usage: "The Home Assistant discovery topic prefix",
+	},
+}
+
+// mqttSink connects to the broker for each result, which suits the long
+// test interval better than keeping a connection alive between runs
+type mqttSink struct {
+	addr       string
+	tlsConfig  *tls.Config
+	topic      string
+	qos        byte
+	retain     bool
+	clientID   string
+	username   string
+	password   string
+	haPrefix   string
+	discovered bool
+}
+
+func newMQTTSink(c *cli.Context) (sink, error) {
+	if c.String("mqtt-broker") == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(c.String("mqtt-broker"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid mqtt broker: %v", err)
+	}
+
+	s := &mqttSink{
+		addr:     u.Host,
+		topic:    c.String("mqtt-topic"),
+		qos:      byte(c.Int("mqtt-qos")),
+		retain:   c.Bool("mqtt-retain"),
+		clientID: c.String("mqtt-client-id"),
+		username: c.String("mqtt-username"),
+		password: c.String("mqtt-password"),
+	}
+
+	if s.qos > 1 {
+		return nil, fmt.Errorf("unsupported mqtt qos %d, only 0 and 1 are supported", s.qos)
+	}
+
+	if c.Bool("mqtt-ha-discovery") {
+		s.haPrefix = c.String("mqtt-ha-prefix")
+	}
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if u.Port() == "" {
+			s.addr = net.JoinHostPort(u.Hostname(), "1883")
+		}
+	case "ssl", "tls", "mqtts":
+		if u.Port() == "" {
+			s.addr = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		s.tlsConfig, err = clientTLSConfig(u.Hostname(), c.String("mqtt-ca-file"), c.Bool("mqtt-insecure-skip-verify"))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported mqtt broker scheme %q", u.Scheme)
+	}
+
+	return s, nil
+}
+
+// clientTLSConfig builds the TLS config for connecting to host, trusting only
+// the CAs in caFile when it's set
+func clientTLSConfig(host string, caFile string, insecure bool) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: host, InsecureSkipVerify: insecure}
+	if caFile == "" {
+		return conf, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ca file: %v", err)
+	}
+
+	conf.RootCAs = x509.NewCertPool()
+	if !conf.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in ca file %s", caFile)
+	}
+
+	return conf, nil
+}
+
+func (s *mqttSink) Name() string {
+	return "mqtt"
+}
+
+func (s *mqttSink) WriteResult(res results) error {
+	payload, err := json.Marshal(resultJSON(res))
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	if s.haPrefix != "" && !s.discovered {
+		for _, d := range haDiscoveryConfigs(s.haPrefix, s.topic, s.clientID) {
+			err = conn.publish(d.topic, d.payload, s.qos, true)
+			if err != nil {
+				return fmt.Errorf("error publishing home assistant discovery: %v", err)
+			}
+		}
+		s.discovered = true
+	}
+
+	return conn.publish(s.topic, payload, s.qos, s.retain)
+}
+
+func (s *mqttSink) Close() error {
+	return nil
+}
+
+// resultJSON flattens a result into the influxDB tags and fields along with
+// its time and duration
+func resultJSON(res results) map[string]interface{} {
+	doc := map[string]interface{}{
+		"timestamp":        res.timestamp.UTC().Format(time.RFC3339),
+		"duration_seconds": res.duration.Seconds(),
+	}
+	for k, v := range resultTags(res) {
+		doc[k] = v
+	}
+	for k, v := range resultFields(res) {
+		doc[k] = v
+	}
+
+	return doc
+}
+
+type haDiscovery struct {
+	topic   string
+	payload []byte
+}
+
+// haSensors are the result values exposed to Home Assistant as sensors
+var haSensors = []struct {
+	key         string
+	name        string
+	unit        string
+	deviceClass string
+}{
+	{"download", "Download", "Mbit/s", "data_rate"},
+	{"upload", "Upload", "Mbit/s", "data_rate"},
+	{"latency", "Latency", "ms", "duration"},
+	{"server_sponsor", "Server", "", ""},
+}
+
+// haDiscoveryConfigs builds the retained discovery config for each sensor,
+// grouped under one device named after the client ID
+func haDiscoveryConfigs(prefix string, stateTopic string, clientID string) []haDiscovery {
+	nodeID := sanitizeGraphiteNode(clientID)
+	device := map[string]interface{}{
+		"identifiers":  []string{nodeID},
+		"name":         "Speedtest",
+		"manufacturer": "speedtest-to-influxdb",
+	}
+
+	var configs []haDiscovery
+	for _, sensor := range haSensors {
+		config := map[string]interface{}{
+			"name":           sensor.name,
+			"unique_id":      nodeID + "_" + sensor.key,
+			"object_id":      nodeID + "_" + sensor.key,
+			"state_topic":    stateTopic,
+			"value_template": fmt.Sprintf("{{ value_json.%s | default(None) }}", sensor.key),
+			"device":         device,
+		}
+		if sensor.unit != "" {
+			config["unit_of_measurement"] = sensor.unit
+			config["device_class"] = sensor.deviceClass
+			config["state_class"] = "measurement"
+		}
+
+		payload, _ := json.Marshal(config)
+		configs = append(configs, haDiscovery{
+			topic:   strings.Join([]string{prefix, "sensor", nodeID, sensor.key, "config"}, "/"),
+			payload: payload,
+		})
+	}
+
+	return configs
+}
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttDisconnect = 14
+)
+
+// mqttConn is just enough of an MQTT 3.1.1 client to connect and publish
+type mqttConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+}
+
+func (s *mqttSink) connect() (*mqttConn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if s.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	m := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	flags := byte(0x02) // clean session
+	if s.username != "" {
+		flags |= 0x80
+		if s.password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags, 0, 60)
+	body = appendMQTTString(body, s.clientID)
+	if s.username != "" {
+		body = appendMQTTString(body, s.username)
+		if s.password != "" {
+			body = appendMQTTString(body, s.password)
+		}
+	}
+
+	err = m.write(mqttConnect<<4, body)
+	if err == nil {
+		err = m.connack()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *mqttConn) connack() error {
+	kind, body, err := m.read()
+	if err != nil {
+		return err
+	}
+	if kind != mqttConnack || len(body) != 2 {
+		return errors.New("mqtt broker didn't acknowledge the connection")
+	}
+
+	switch body[1] {
+	case 0:
+		return nil
+	case 4, 5:
+		return fmt.Errorf("mqtt broker refused the connection, not authorized (code %d)", body[1])
+	default:
+		return fmt.Errorf("mqtt broker refused the connection (code %d)", body[1])
+	}
+}
+
+// publish sends the message, waiting for the broker's acknowledgement at QoS 1
+func (m *mqttConn) publish(topic string, payload []byte, qos byte, retain bool) error {
+	header := byte(mqttPublish<<4) | qos<<1
+	if retain {
+		header |= 0x01
+	}
+
+	body := appendMQTTString(nil, topic)
+	if qos > 0 {
+		m.packetID++
+		body = append(body, byte(m.packetID>>8), byte(m.packetID))
+	}
+	body = append(body, payload...)
+
+	err := m.write(header, body)
+	if err != nil || qos == 0 {
+		return err
+	}
+
+	kind, ack, err := m.read()
+	if err != nil {
+		return err
+	}
+	if kind != mqttPuback || len(ack) != 2 || binary.BigEndian.Uint16(ack) != m.packetID {
+		return errors.New("mqtt broker didn't acknowledge the publish")
+	}
+
+	return nil
+}
+
+func (m *mqttConn) close() error {
+	m.write(mqttDisconnect<<4, nil)
+	return m.conn.Close()
+}
+
+func (m *mqttConn) write(header byte, body []byte) error {
+	packet := []byte{header}
+	packet = appendMQTTLength(packet, len(body))
+	packet = append(packet, body...)
+
+	_, err := m.conn.Write(packet)
+	return err
+}
+
+func (m *mqttConn) read() (byte, []byte, error) {
+	header, err := m.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := m.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if i == 4 {
+			return 0, nil, errors.New("malformed mqtt remaining length")
+		}
+
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(m.r, body)
+	return header >> 4, body, err
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// appendMQTTLength encodes the remaining length, seven bits at a time
+func appendMQTTLength(b []byte, length int) []byte {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeBroker accepts one connection, acknowledging the connect and every
+// QoS 1 publish, and reports the topics published to
+type fakeBroker struct {
+	l         net.Listener
+	connect   chan []byte
+	published chan string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBroker{l: l, connect: make(chan []byte, 1), published: make(chan string, 16)}
+	go b.serve()
+	return b
+}
+
+func (b *fakeBroker) serve() {
+	defer close(b.published)
+
+	conn, err := b.l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	m := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+	for {
+		kind, body, err := m.read()
+		if err != nil {
+			return
+		}
+
+		switch kind {
+		case mqttConnect:
+			b.connect <- body
+			m.write(mqttConnack<<4, []byte{0, 0})
+		case mqttPublish:
+			n := int(body[0])<<8 | int(body[1])
+			b.published <- string(body[2 : 2+n])
+			m.write(mqttPuback<<4, body[2+n:2+n+2])
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+func Test_mqttSink_WriteResult(t *testing.T) {
+	broker := newFakeBroker(t)
+	defer broker.l.Close()
+
+	s := &mqttSink{
+		addr:     broker.l.Addr().String(),
+		topic:    "speedtest/result",
+		qos:      1,
+		clientID: "speedtest",
+		username: "home",
+		password: "s3cret",
+		haPrefix: "homeassistant",
+	}
+
+	err := s.WriteResult(results{latency: floatPtr(9.5), timestamp: time.Unix(1525500000, 0)})
+	if err != nil {
+		t.Fatalf("mqttSink.WriteResult() error = %v", err)
+	}
+
+	connect := <-broker.connect
+	if flags := connect[7]; flags != 0xc2 {
+		t.Errorf("connect flags = %#x, want username, password and clean session", flags)
+	}
+
+	var got []string
+	for topic := range broker.published {
+		got = append(got, topic)
+	}
+	want := []string{
+		"homeassistant/sensor/speedtest/download/config",
+		"homeassistant/sensor/speedtest/upload/config",
+		"homeassistant/sensor/speedtest/latency/config",
+		"homeassistant/sensor/speedtest/server_sponsor/config",
+		"speedtest/result",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("published to %q, want %q", got, want)
+	}
+}
+
+func Test_resultJSON(t *testing.T) {
+	res := results{
+		latency:     floatPtr(9.5),
+		failedPhase: phaseDownload,
+		timestamp:   time.Unix(1525500000, 0),
+		duration:    1500 * time.Millisecond,
+	}
+
+	b, err := json.Marshal(resultJSON(res))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"duration_seconds":1.5,"failed_phase":"download","latency":9.5,"status":"partial","timestamp":"2018-05-05T06:00:00Z"}`
+	if string(b) != want {
+		t.Errorf("resultJSON() = %s, want %s", b, want)
+	}
+}
+
+func Test_appendMQTTLength(t *testing.T) {
+	tests := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		if got := appendMQTTLength(nil, tt.length); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("appendMQTTLength(%d) = %x, want %x", tt.length, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var notifyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "notify-on",
+		Value: "failure,outage,threshold,anomaly",
+		Usage: "What to notify about, comma separated from summary, failure, outage, threshold, anomaly and digest",
+	},
+	cli.StringFlag{
+		Name:  "notify-digest",
+		Usage: "Send a digest of the results every period, daily or weekly, disabled when empty",
+	},
+	cli.IntFlag{
+		Name:  "notify-rate-limit",
+		Value: 6,
+		Usage: "The most notifications sent to each channel per hour, 0 disables the limit",
+	},
+	cli.StringFlag{
+		Name:   "notify-slack-webhook-url",
+		Usage:  "Notify this slack incoming webhook",
+		EnvVar: "NOTIFY_SLACK_WEBHOOK_URL",
+	},
+	cli.StringFlag{
+		Name:   "notify-discord-webhook-url",
+		Usage:  "Notify this discord webhook",
+		EnvVar: "NOTIFY_DISCORD_WEBHOOK_URL",
+	},
+	cli.StringFlag{
+		Name:   "notify-telegram-bot-token",
+		Usage:  "Notify through this telegram bot, needs --notify-telegram-chat-id",
+		EnvVar: "NOTIFY_TELEGRAM_BOT_TOKEN",
+	},
+	cli.StringFlag{
+		Name:  "notify-telegram-chat-id",
+		Usage: "The telegram chat the bot posts to",
+	},
+	cli.StringFlag{
+		Name:  "notify-ntfy-url",
+		Usage: "Notify this ntfy topic URL, such as https://ntfy.sh/my-topic",
+	},
+	cli.StringFlag{
+		Name:   "notify-ntfy-token",
+		Usage:  "The access token for a protected ntfy topic",
+		EnvVar: "NOTIFY_NTFY_TOKEN",
+	},
+	cli.StringFlag{
+		Name:  "notify-webhook-url",
+		Usage: "POST every notification to this URL as JSON",
+	},
+}
+
+// notification kinds, selected with --notify-on
+const (
+	notifySummary   = "summary"
+	notifyFailure   = "failure"
+	notifyOutage    = "outage"
+	notifyThreshold = "threshold"
+	notifyDigest    = "digest"
+	notifyAnomaly   = "anomaly"
+)
+
+// notification severities, used for colours and priorities
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// notification is a message for people, as opposed to the results and events
+// written for machines
+type notification struct {
+	kind     string
+	severity string
+	title    string
+	message  string
+	at       time.Time
+
+	// channels routes the notification to just these notifiers, whatever
+	// kinds they've chosen
+	channels []string
+}
+
+// notifier delivers notifications to one channel
+type notifier interface {
+	Name() string
+	Notify(n notification) error
+}
+
+// notifierFactories build the configured notifiers, returning a nil notifier
+// when one isn't enabled
+var notifierFactories = []func(c *cli.Context) (notifier, error){
+	newSlackNotifier,
+	newDiscordNotifier,
+	newTelegramNotifier,
+	newNtfyNotifier,
+	newWebhookNotifier,
+	newEmailNotifier,
+}
+
+// rateLimiter allows a number of sends in any window, so a flapping link
+// can't flood a channel
+type rateLimiter struct {
+	max    int
+	window time.Duration
+
+	mu   sync.Mutex
+	sent []time.Time
+}
+
+// allow records a send at now if the limit allows it
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l.max <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recent := l.sent[:0]
+	for _, at := range l.sent {
+		if now.Sub(at) < l.window {
+			recent = append(recent, at)
+		}
+	}
+	l.sent = recent
+
+	if len(l.sent) >= l.max {
+		return false
+	}
+	l.sent = append(l.sent, now)
+
+	return true
+}
+
+// selectiveNotifier is implemented by notifiers that choose their own kinds
+// of notification instead of following --notify-on
+type selectiveNotifier interface {
+	notifyKinds() map[string]bool
+}
+
+// notifyChannel is a notifier with its own rate limit
+type notifyChannel struct {
+	notifier notifier
+	kinds    map[string]bool
+	limiter  *rateLimiter
+}
+
+// notifySink turns results and events into notifications and sends them to
+// every channel that wants them
+type notifySink struct {
+	channels []*notifyChannel
+	routes   map[string][]string
+	digest   *digest
+	now      func() time.Time
+
+	// mu is held while notifying, the digest is also checked between results
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// digestCheckInterval is how often a due digest is looked for between
+// results, so an outage or a long --interval doesn't hold it up
+const digestCheckInterval = time.Minute
+
+func newNotifySink(c *cli.Context) (sink, error) {
+	kinds, err := parseNotifyKinds(c.String("notify-on"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &notifySink{now: time.Now}
+	for _, factory := range notifierFactories {
+		n, err := factory(c)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			continue
+		}
+
+		ch := &notifyChannel{
+			notifier: n,
+			kinds:    kinds,
+			limiter:  &rateLimiter{max: c.Int("notify-rate-limit"), window: time.Hour},
+		}
+		if sel, ok := n.(selectiveNotifier); ok {
+			ch.kinds = sel.notifyKinds()
+		}
+		s.channels = append(s.channels, ch)
+	}
+
+	rules, err := parseRules(c.StringSlice("alert-rule"))
+	if err != nil {
+		return nil, err
+	}
+	s.routes = map[string][]string{}
+	for _, r := range rules {
+		for _, name := range r.notify {
+			if !s.hasChannel(name) {
+				return nil, fmt.Errorf("alert rule %s notifies %s, which isn't configured", r.name, name)
+			}
+		}
+		s.routes[r.name] = r.notify
+	}
+
+	if len(s.channels) == 0 {
+		return nil, nil
+	}
+
+	switch c.String("notify-digest") {
+	case "":
+	case digestDaily, digestWeekly:
+		s.digest = newDigest(c.String("notify-digest"), s.now())
+		s.checkDigest(digestCheckInterval)
+	default:
+		return nil, fmt.Errorf("unsupported digest period %q", c.String("notify-digest"))
+	}
+
+	return s, nil
+}
+
+// parseNotifyKinds reads a comma separated list of notification kinds
+func parseNotifyKinds(list string) (map[string]bool, error) {
+	kinds := map[string]bool{}
+	for _, kind := range strings.Split(list, ",") {
+		kind = strings.TrimSpace(kind)
+		switch kind {
+		case "":
+		case notifySummary, notifyFailure, notifyOutage, notifyThreshold, notifyDigest, notifyAnomaly:
+			kinds[kind] = true
+		default:
+			return nil, fmt.Errorf("unsupported notification kind %q", kind)
+		}
+	}
+
+	return kinds, nil
+}
+
+func (s *notifySink) Name() string {
+	return "notify"
+}
+
+func (s *notifySink) WriteResult(res results) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.digest != nil {
+		err = s.sendDigest()
+		s.digest.add(res)
+	}
+
+	// channels that don't want failures still get them as summaries
+	candidates := []notification{summaryNotification(res)}
+	if res.status() != statusOK {
+		candidates = append([]notification{failureNotification(res)}, candidates...)
+	}
+
+	if nerr := s.notify(candidates...); nerr != nil {
+		err = nerr
+	}
+
+	return err
+}
+
+func (s *notifySink) hasChannel(name string) bool {
+	for _, ch := range s.channels {
+		if ch.notifier.Name() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *notifySink) WriteEvent(ev event) error {
+	n, ok := eventNotification(ev)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ev.name == "speedtest_alert" {
+		n.channels = s.routes[ev.tags["rule"]]
+	}
+
+	return s.notify(n)
+}
+
+// checkDigest sends the digest once it's due every interval until the sink
+// is closed, not only when the next result comes in
+func (s *notifySink) checkDigest(interval time.Duration) {
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.mu.Lock()
+				s.sendDigest()
+				s.mu.Unlock()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// sendDigest sends the digest if its period is over, with mu held
+func (s *notifySink) sendDigest() error {
+	n, ok := s.digest.due(s.now())
+	if !ok {
+		return nil
+	}
+
+	return s.notify(n)
+}
+
+// notify sends each channel the first of the candidates it wants, if it's
+// under its rate limit, returning the last error
+func (s *notifySink) notify(candidates ...notification) error {
+	var lastErr error
+	for _, ch := range s.channels {
+		n, ok := ch.pick(candidates)
+		if !ok {
+			continue
+		}
+
+		// digests are already limited to one a period
+		if n.kind != notifyDigest && !ch.limiter.allow(s.now()) {
+			log.Printf("%s notifications are rate limited, dropping %q", ch.notifier.Name(), n.title)
+			continue
+		}
+
+		err := ch.notifier.Notify(n)
+		if err != nil {
+			lastErr = fmt.Errorf("error notifying %s: %v", ch.notifier.Name(), err)
+			log.Print(lastErr)
+		}
+	}
+
+	return lastErr
+}
+
+func (ch *notifyChannel) pick(candidates []notification) (notification, bool) {
+	for _, n := range candidates {
+		if len(n.channels) == 0 && ch.kinds[n.kind] {
+			return n, true
+		}
+		for _, name := range n.channels {
+			if name == ch.notifier.Name() {
+				return n, true
+			}
+		}
+	}
+
+	return notification{}, false
+}
+
+func (s *notifySink) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+
+	return nil
+}
+
+func summaryNotification(res results) notification {
+	return notification{
+		kind:     notifySummary,
+		severity: severityInfo,
+		title:    "Speedtest result",
+		message:  resultSummary(res),
+		at:       res.timestamp,
+	}
+}
+
+func failureNotification(res results) notification {
+	severity, title := severityWarning, "Speedtest partially failed"
+	if res.status() == statusFailed {
+		severity, title = severityCritical, "Speedtest failed"
+	}
+
+	message := fmt.Sprintf("The %s phase failed", res.failedPhase)
+	if res.err != nil {
+		message += ": " + res.err.Error()
+	}
+	if res.status() == statusPartial {
+		message += "\n" + resultSummary(res)
+	}
+
+	return notification{
+		kind:     notifyFailure,
+		severity: severity,
+		title:    title,
+		message:  message,
+		at:       res.timestamp,
+	}
+}
+
+// resultSummary describes the measured values in a line
+func resultSummary(res results) string {
+	var parts []string
+	if res.download != nil {
+		parts = append(parts, fmt.Sprintf("download %.2f Mbit/s", *res.download))
+	}
+	if res.upload != nil {
+		parts = append(parts, fmt.Sprintf("upload %.2f Mbit/s", *res.upload))
+	}
+	if res.latency != nil {
+		parts = append(parts, fmt.Sprintf("latency %.2f ms", *res.latency))
+	}
+
+	summary := strings.Join(parts, ", ")
+	if res.server.ID != "" {
+		summary += fmt.Sprintf(" via %s (%s, %s)", res.server.Sponsor, res.server.Name, res.server.Country)
+	}
+
+	return strings.TrimSpace(summary)
+}
+
+// eventNotification describes the events people want to hear about
+func eventNotification(ev event) (notification, bool) {
+	switch ev.name {
+	case "speedtest_outage":
+		if ev.tags["event"] == outageStart {
+			return notification{
+				kind:     notifyOutage,
+				severity: severityCritical,
+				title:    "Outage started",
+				message:  fmt.Sprintf("Connectivity lost at %s", ev.at.Format(time.RFC1123)),
+				at:       ev.at,
+			}, true
+		}
+
+		duration, _ := ev.fields["duration_seconds"].(float64)
+		return notification{
+			kind:     notifyOutage,
+			severity: severityInfo,
+			title:    "Outage ended",
+			message:  fmt.Sprintf("Connectivity restored after %s", time.Duration(duration*float64(time.Second)).Round(time.Second)),
+			at:       ev.at,
+		}, true
+	case "speedtest_alert":
+		value, _ := ev.fields["value"].(float64)
+		condition, _ := ev.fields["condition"].(string)
+		if ev.tags["state"] == alertFiring {
+			return notification{
+				kind:     notifyThreshold,
+				severity: severityWarning,
+				title:    "Alert firing: " + ev.tags["rule"],
+				message:  fmt.Sprintf("%s is %.2f, breaching %s", ev.tags["metric"], value, condition),
+				at:       ev.at,
+			}, true
+		}
+
+		return notification{
+			kind:     notifyThreshold,
+			severity: severityInfo,
+			title:    "Alert resolved: " + ev.tags["rule"],
+			message:  fmt.Sprintf("%s is back to %.2f, clearing %s", ev.tags["metric"], value, condition),
+			at:       ev.at,
+		}, true
+	case "speedtest_anomaly":
+		value, _ := ev.fields["value"].(float64)
+		baseline, _ := ev.fields["baseline"].(float64)
+		score, _ := ev.fields["anomaly_score"].(float64)
+		return notification{
+			kind:     notifyAnomaly,
+			severity: severityWarning,
+			title:    "Anomalous " + ev.tags["metric"],
+			message: fmt.Sprintf("%s from server %s is %.2f against a usual %.2f for this time of day, anomaly score %.1f",
+				ev.tags["metric"], ev.tags["server_id"], value, baseline, score),
+			at: ev.at,
+		}, true
+	}
+
+	return notification{}, false
+}
+
+// postJSON sends a JSON body, for the channels that take one
+func postJSON(httpClient *http.Client, endpoint string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(b))
+	if err != nil {
+		return redactURLError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "speedtest-to-influxdb")
+
+	return doNotify(httpClient, req)
+}
+
+func doNotify(httpClient *http.Client, req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return redactURLError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+// redactURLError drops the URL from a request error, webhook URLs and the
+// telegram bot token are secrets that mustn't end up in the logs
+func redactURLError(err error) error {
+	if e, ok := err.(*url.Error); ok {
+		return fmt.Errorf("%s request failed: %v", e.Op, e.Err)
+	}
+
+	return err
+}
+
+// slackNotifier posts to a slack incoming webhook
+type slackNotifier struct {
+	url        string
+	httpClient *http.Client
+}
+
+func newSlackNotifier(c *cli.Context) (notifier, error) {
+	if c.String("notify-slack-webhook-url") == "" {
+		return nil, nil
+	}
+
+	return &slackNotifier{url: c.String("notify-slack-webhook-url"), httpClient: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (n *slackNotifier) Name() string {
+	return "slack"
+}
+
+// slackEmoji marks the severity, incoming webhooks can't colour plain text
+var slackEmoji = map[string]string{
+	severityInfo:     ":information_source:",
+	severityWarning:  ":warning:",
+	severityCritical: ":rotating_light:",
+}
+
+func (n *slackNotifier) Notify(msg notification) error {
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	return postJSON(n.httpClient, n.url, map[string]string{
+		"text": fmt.Sprintf("%s *%s*\n%s", slackEmoji[msg.severity], escape.Replace(msg.title), escape.Replace(msg.message)),
+	})
+}
+
+// discordNotifier posts an embed to a discord webhook
+type discordNotifier struct {
+	url        string
+	httpClient *http.Client
+}
+
+func newDiscordNotifier(c *cli.Context) (notifier, error) {
+	if c.String("notify-discord-webhook-url") == "" {
+		return nil, nil
+	}
+
+	return &discordNotifier{url: c.String("notify-discord-webhook-url"), httpClient: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (n *discordNotifier) Name() string {
+	return "discord"
+}
+
+// discordColours are the embed colours for each severity
+var discordColours = map[string]int{
+	severityInfo:     0x3498db,
+	severityWarning:  0xf1c40f,
+	severityCritical: 0xe74c3c,
+}
+
+func (n *discordNotifier) Notify(msg notification) error {
+	embed := map[string]interface{}{
+		"title":       msg.title,
+		"description": msg.message,
+		"color":       discordColours[msg.severity],
+	}
+	if !msg.at.IsZero() {
+		embed["timestamp"] = msg.at.UTC().Format(time.RFC3339)
+	}
+
+	return postJSON(n.httpClient, n.url, map[string]interface{}{
+		"username": "speedtest",
+		"embeds":   []interface{}{embed},
+	})
+}
+
+// telegramNotifier sends messages through the telegram bot API
+type telegramNotifier struct {
+	apiURL     string
+	token      string
+	chatID     string
+	httpClient *http.Client
+}
+
+func newTelegramNotifier(c *cli.Context) (notifier, error) {
+	if c.String("notify-telegram-bot-token") == "" {
+		return nil, nil
+	}
+	if c.String("notify-telegram-chat-id") == "" {
+		return nil, fmt.Errorf("--notify-telegram-chat-id is required with a telegram bot token")
+	}
+
+	return &telegramNotifier{
+		apiURL:     "https://api.telegram.org",
+		token:      c.String("notify-telegram-bot-token"),
+		chatID:     c.String("notify-telegram-chat-id"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (n *telegramNotifier) Name() string {
+	return "telegram"
+}
+
+func (n *telegramNotifier) Notify(msg notification) error {
+	return postJSON(n.httpClient, n.apiURL+"/bot"+n.token+"/sendMessage", map[string]interface{}{
+		"chat_id":    n.chatID,
+		"parse_mode": "HTML",
+		"text":       fmt.Sprintf("<b>%s</b>\n%s", html.EscapeString(msg.title), html.EscapeString(msg.message)),
+	})
+}
+
+// ntfyNotifier publishes to an ntfy topic
+type ntfyNotifier struct {
+	url        string
+	token      string
+	httpClient *http.Client
+}
+
+func newNtfyNotifier(c *cli.Context) (notifier, error) {
+	if c.String("notify-ntfy-url") == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(c.String("notify-ntfy-url"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ntfy url: %v", err)
+	} else if strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("the ntfy url needs a topic, such as https://ntfy.sh/my-topic")
+	}
+
+	return &ntfyNotifier{url: u.String(), token: c.String("notify-ntfy-token"), httpClient: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (n *ntfyNotifier) Name() string {
+	return "ntfy"
+}
+
+// ntfyPriorities and ntfyTags map severities onto ntfy's headers
+var (
+	ntfyPriorities = map[string]string{severityInfo: "default", severityWarning: "high", severityCritical: "urgent"}
+	ntfyTags       = map[string]string{severityInfo: "information_source", severityWarning: "warning", severityCritical: "rotating_light"}
+)
+
+func (n *ntfyNotifier) Notify(msg notification) error {
+	req, err := http.NewRequest("POST", n.url, strings.NewReader(msg.message))
+	if err != nil {
+		return redactURLError(err)
+	}
+
+	req.Header.Set("Title", msg.title)
+	req.Header.Set("Priority", ntfyPriorities[msg.severity])
+	req.Header.Set("Tags", ntfyTags[msg.severity])
+	req.Header.Set("User-Agent", "speedtest-to-influxdb")
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+
+	return doNotify(n.httpClient, req)
+}
+
+// webhookNotifier posts the notification as JSON, for anything without its
+// own formatter
+type webhookNotifier struct {
+	url        string
+	httpClient *http.Client
+}
+
+func newWebhookNotifier(c *cli.Context) (notifier, error) {
+	if c.String("notify-webhook-url") == "" {
+		return nil, nil
+	}
+
+	return &webhookNotifier{url: c.String("notify-webhook-url"), httpClient: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (n *webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (n *webhookNotifier) Notify(msg notification) error {
+	return postJSON(n.httpClient, n.url, map[string]string{
+		"kind":      msg.kind,
+		"severity":  msg.severity,
+		"title":     msg.title,
+		"message":   msg.message,
+		"timestamp": msg.at.UTC().Format(time.RFC3339),
+	})
+}
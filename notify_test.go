@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifier records the notifications sent to it
+type fakeNotifier struct {
+	name string
+	sent []notification
+}
+
+func (n *fakeNotifier) Name() string {
+	return n.name
+}
+
+func (n *fakeNotifier) Notify(msg notification) error {
+	n.sent = append(n.sent, msg)
+	return nil
+}
+
+func Test_rateLimiter_allow(t *testing.T) {
+	l := &rateLimiter{max: 2, window: time.Hour}
+	start := time.Unix(1500000000, 0)
+
+	tests := []struct {
+		at   time.Duration
+		want bool
+	}{
+		{0, true},
+		{time.Minute, true},
+		{2 * time.Minute, false},
+		{59 * time.Minute, false},
+		{time.Hour, true},
+		{time.Hour + 30*time.Second, false},
+		{time.Hour + time.Minute, true},
+	}
+	for _, tt := range tests {
+		if got := l.allow(start.Add(tt.at)); got != tt.want {
+			t.Errorf("allow() at %s = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func Test_notifySink(t *testing.T) {
+	failed := results{failedPhase: phaseConfig, err: errors.New("no route to host")}
+	ok := results{latency: floatPtr(9.5), download: floatPtr(94.2), upload: floatPtr(11.7), server: testServer}
+
+	tests := []struct {
+		name  string
+		kinds map[string]bool
+		write func(s *notifySink) error
+		want  []notification
+	}{
+		{
+			name:  "failure",
+			kinds: map[string]bool{notifyFailure: true},
+			write: func(s *notifySink) error { return s.WriteResult(failed) },
+			want: []notification{{
+				kind:     notifyFailure,
+				severity: severityCritical,
+				title:    "Speedtest failed",
+				message:  "The config phase failed: no route to host",
+			}},
+		},
+		{
+			name:  "summary",
+			kinds: map[string]bool{notifyFailure: true, notifySummary: true},
+			write: func(s *notifySink) error { return s.WriteResult(ok) },
+			want: []notification{{
+				kind:     notifySummary,
+				severity: severityInfo,
+				title:    "Speedtest result",
+				message:  "download 94.20 Mbit/s, upload 11.70 Mbit/s, latency 9.50 ms via Example ISP (Springfield, United States)",
+			}},
+		},
+		{
+			name:  "summaries not selected",
+			kinds: map[string]bool{notifyFailure: true},
+			write: func(s *notifySink) error { return s.WriteResult(ok) },
+		},
+		{
+			name:  "outage ended",
+			kinds: map[string]bool{notifyOutage: true},
+			write: func(s *notifySink) error {
+				return s.WriteEvent(outageEvent{kind: outageEnd, start: time.Unix(0, 0), end: time.Unix(90, 0)}.event())
+			},
+			want: []notification{{
+				kind:     notifyOutage,
+				severity: severityInfo,
+				title:    "Outage ended",
+				message:  "Connectivity restored after 1m30s",
+				at:       time.Unix(90, 0),
+			}},
+		},
+		{
+			name:  "anomaly",
+			kinds: map[string]bool{notifyAnomaly: true},
+			write: func(s *notifySink) error {
+				return s.WriteEvent(event{
+					name:   "speedtest_anomaly",
+					tags:   map[string]string{"server_id": "1234", "metric": "download"},
+					fields: map[string]interface{}{"anomaly_score": 10.0, "value": 47.0, "baseline": 94.0},
+					at:     time.Unix(90, 0),
+				})
+			},
+			want: []notification{{
+				kind:     notifyAnomaly,
+				severity: severityWarning,
+				title:    "Anomalous download",
+				message:  "download from server 1234 is 47.00 against a usual 94.00 for this time of day, anomaly score 10.0",
+				at:       time.Unix(90, 0),
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &fakeNotifier{name: "fake"}
+			s := &notifySink{
+				channels: []*notifyChannel{{notifier: n, kinds: tt.kinds, limiter: &rateLimiter{}}},
+				now:      time.Now,
+			}
+
+			if err := tt.write(s); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+			if !reflect.DeepEqual(n.sent, tt.want) {
+				t.Errorf("sent %+v, want %+v", n.sent, tt.want)
+			}
+		})
+	}
+}
+
+func Test_notifySink_routing(t *testing.T) {
+	slack, email := &fakeNotifier{name: "slack"}, &fakeNotifier{name: "email"}
+	s := &notifySink{
+		channels: []*notifyChannel{
+			{notifier: slack, kinds: map[string]bool{notifyThreshold: true}, limiter: &rateLimiter{}},
+			{notifier: email, kinds: map[string]bool{}, limiter: &rateLimiter{}},
+		},
+		routes: map[string][]string{"slow": {"email"}},
+		now:    time.Now,
+	}
+
+	rules, err := parseRules([]string{"slow: download < 80", "laggy: latency > 50"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range newRuleEngine(rules).evaluate(results{download: floatPtr(20), latency: floatPtr(60)}) {
+		if err := s.WriteEvent(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(email.sent) != 1 || email.sent[0].title != "Alert firing: slow" {
+		t.Errorf("email sent %+v, want just the routed slow alert", email.sent)
+	}
+	if len(slack.sent) != 1 || slack.sent[0].message != "latency is 60.00, breaching latency > 50" {
+		t.Errorf("slack sent %+v, want just the unrouted laggy alert", slack.sent)
+	}
+}
+
+func Test_notifySink_checkDigest(t *testing.T) {
+	start := time.Date(2018, 5, 2, 15, 30, 0, 0, time.UTC)
+	n := &fakeNotifier{name: "fake"}
+	s := &notifySink{
+		channels: []*notifyChannel{{notifier: n, kinds: map[string]bool{notifyDigest: true}, limiter: &rateLimiter{}}},
+		digest:   newDigest(digestDaily, start),
+		now:      func() time.Time { return start },
+	}
+	if err := s.WriteResult(results{latency: floatPtr(9.5)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the day is over but no result comes in, as during an outage
+	s.now = func() time.Time { return start.Add(24 * time.Hour) }
+	s.checkDigest(time.Millisecond)
+	defer s.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		sent := len(n.sent)
+		s.mu.Unlock()
+		if sent > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the digest wasn't sent until the next result")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if n.sent[0].kind != notifyDigest || len(n.sent) != 1 {
+		t.Errorf("sent %+v, want one digest", n.sent)
+	}
+}
+
+func Test_notifiers(t *testing.T) {
+	msg := notification{
+		kind:     notifyFailure,
+		severity: severityCritical,
+		title:    "Speedtest failed",
+		message:  "The config phase failed: <timeout>",
+		at:       time.Unix(1500000000, 0),
+	}
+
+	tests := []struct {
+		name       string
+		notifier   func(url string, c *http.Client) notifier
+		wantPath   string
+		wantBody   string
+		wantHeader http.Header
+	}{
+		{
+			name:     "slack",
+			notifier: func(url string, c *http.Client) notifier { return &slackNotifier{url: url + "/hook", httpClient: c} },
+			wantPath: "/hook",
+			wantBody: `{"text":":rotating_light: *Speedtest failed*\nThe config phase failed: \u0026lt;timeout\u0026gt;"}`,
+		},
+		{
+			name:     "discord",
+			notifier: func(url string, c *http.Client) notifier { return &discordNotifier{url: url + "/hook", httpClient: c} },
+			wantPath: "/hook",
+			wantBody: `{"embeds":[{"color":15158332,"description":"The config phase failed: \u003ctimeout\u003e","timestamp":"2017-07-14T02:40:00Z","title":"Speedtest failed"}],"username":"speedtest"}`,
+		},
+		{
+			name: "telegram",
+			notifier: func(url string, c *http.Client) notifier {
+				return &telegramNotifier{apiURL: url, token: "123:abc", chatID: "-42", httpClient: c}
+			},
+			wantPath: "/bot123:abc/sendMessage",
+			wantBody: `{"chat_id":"-42","parse_mode":"HTML","text":"\u003cb\u003eSpeedtest failed\u003c/b\u003e\nThe config phase failed: \u0026lt;timeout\u0026gt;"}`,
+		},
+		{
+			name: "ntfy",
+			notifier: func(url string, c *http.Client) notifier {
+				return &ntfyNotifier{url: url + "/alerts", token: "tk", httpClient: c}
+			},
+			wantPath:   "/alerts",
+			wantBody:   "The config phase failed: <timeout>",
+			wantHeader: http.Header{"Title": {"Speedtest failed"}, "Priority": {"urgent"}, "Authorization": {"Bearer tk"}},
+		},
+		{
+			name:     "webhook",
+			notifier: func(url string, c *http.Client) notifier { return &webhookNotifier{url: url + "/hook", httpClient: c} },
+			wantPath: "/hook",
+			wantBody: `{"kind":"failure","message":"The config phase failed: \u003ctimeout\u003e","severity":"critical","timestamp":"2017-07-14T02:40:00Z","title":"Speedtest failed"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if r.URL.Path != tt.wantPath {
+					t.Errorf("path = %s, want %s", r.URL.Path, tt.wantPath)
+				}
+				if string(body) != tt.wantBody {
+					t.Errorf("body = %s, want %s", body, tt.wantBody)
+				}
+				for k := range tt.wantHeader {
+					if got := r.Header.Get(k); got != tt.wantHeader.Get(k) {
+						t.Errorf("%s header = %q, want %q", k, got, tt.wantHeader.Get(k))
+					}
+				}
+			}))
+			defer srv.Close()
+
+			if err := tt.notifier(srv.URL, srv.Client()).Notify(msg); err != nil {
+				t.Errorf("Notify() error = %v", err)
+			}
+		})
+	}
+}
+
+func Test_notifiers_redactURL(t *testing.T) {
+	// nothing listens on port 1, so the request fails before any response
+	n := &telegramNotifier{apiURL: "http://127.0.0.1:1", token: "123:secret", chatID: "-42", httpClient: &http.Client{}}
+
+	err := n.Notify(notification{title: "Speedtest failed", at: time.Unix(1500000000, 0)})
+	if err == nil {
+		t.Fatal("Notify() error = nil, want a connection error")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("Notify() error = %q, leaks the bot token", err)
+	}
+}
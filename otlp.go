@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var otlpFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "otlp-endpoint",
+		Usage: "Export results to this OTLP collector, e.g. http://localhost:4318, or http://localhost:4317 for grpc, disabled when empty",
+	},
+	cli.StringFlag{
+		Name:  "otlp-protocol",
+		Value: "http/protobuf",
+		Usage: "The OTLP protocol, http/protobuf or grpc, grpc to an http endpoint uses plaintext HTTP/2 (h2c)",
+	},
+	cli.StringFlag{
+		Name:   "otlp-headers",
+		Usage:  "Extra headers to send to the collector as key=value pairs separated by commas",
+		EnvVar: "OTEL_EXPORTER_OTLP_HEADERS",
+	},
+	cli.StringFlag{
+		Name:  "otlp-server-attributes",
+		Value: "datapoint",
+		Usage: "Where to put the server attributes, datapoint or resource",
+	},
+	cli.StringFlag{
+		Name:  "otlp-ca-file",
+		Usage: "A PEM file of CA certificates to verify the collector with",
+	},
+	cli.BoolFlag{
+		Name:  "otlp-insecure-skip-verify",
+		Usage: "Don't verify the collector certificate",
+	},
+}
+
+// otlpDurationBounds are the test duration histogram bucket bounds, in seconds
+var otlpDurationBounds = []float64{5, 10, 20, 30, 45, 60, 90, 120, 180, 300}
+
+// otlpGauges maps the numeric result fields to the exported gauges
+var otlpGauges = []struct {
+	field string
+	name  string
+	unit  string
+	help  string
+}{
+	{"latency", "speedtest.latency", "ms", "Latency to the speedtest server."},
+	{"download", "speedtest.download", "Mbit/s", "Download speed."},
+	{"upload", "speedtest.upload", "Mbit/s", "Upload speed."},
+}
+
+// otlpSink exports each result as gauges and keeps a cumulative histogram of
+// test durations since startup, which has no data point attributes as it
+// spans every server and status
+type otlpSink struct {
+	url                string
+	grpc               bool
+	headers            map[string]string
+	resourceAttributes bool
+	httpClient         *http.Client
+
+	start        time.Time
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+func newOTLPSink(c *cli.Context) (sink, error) {
+	if c.String("otlp-endpoint") == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(c.String("otlp-endpoint"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp endpoint: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported otlp endpoint scheme %q", u.Scheme)
+	}
+
+	s := &otlpSink{
+		start:        time.Now(),
+		bucketCounts: make([]uint64, len(otlpDurationBounds)+1),
+	}
+
+	switch c.String("otlp-protocol") {
+	case "http/protobuf":
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/metrics"
+	case "grpc":
+		s.grpc = true
+		u.Path = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	default:
+		return nil, fmt.Errorf("unsupported otlp protocol %q", c.String("otlp-protocol"))
+	}
+	s.url = u.String()
+
+	switch c.String("otlp-server-attributes") {
+	case "datapoint":
+	case "resource":
+		s.resourceAttributes = true
+	default:
+		return nil, fmt.Errorf("unsupported otlp server attributes placement %q", c.String("otlp-server-attributes"))
+	}
+
+	s.headers, err = parseKeyValues(c.String("otlp-headers"))
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := clientTLSConfig("", c.String("otlp-ca-file"), c.Bool("otlp-insecure-skip-verify"))
+	if err != nil {
+		return nil, err
+	}
+	s.httpClient = newOTLPClient(s.grpc && u.Scheme == "http", tlsConfig)
+
+	return s, nil
+}
+
+// newOTLPClient builds the collector client. grpc needs HTTP/2, which a
+// plaintext collector only speaks with prior knowledge (h2c).
+func newOTLPClient(h2c bool, tlsConfig *tls.Config) *http.Client {
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+	}
+	if h2c {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}
+}
+
+// parseKeyValues reads comma separated key=value pairs, the format of
+// OTEL_EXPORTER_OTLP_HEADERS, with the values URL decoded
+func parseKeyValues(s string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid pair %q, want key=value", pair)
+		}
+
+		value, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pair %q: %v", pair, err)
+		}
+		headers[strings.TrimSpace(kv[0])] = value
+	}
+
+	return headers, nil
+}
+
+func (s *otlpSink) Name() string {
+	return "otlp"
+}
+
+func (s *otlpSink) WriteResult(res results) error {
+	s.observe(res.duration)
+	body := s.encode(res)
+
+	if s.grpc {
+		// length-prefixed message, uncompressed
+		framed := make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(framed[1:], uint32(len(body)))
+		body = append(framed, body...)
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", "speedtest-to-influxdb")
+	if s.grpc {
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp collector returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	if s.grpc {
+		// grpc-status is a trailer, or a header on trailers-only responses
+		status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+		}
+		if status != "0" {
+			return fmt.Errorf("otlp collector returned grpc status %s: %s", status, message)
+		}
+	}
+
+	return nil
+}
+
+func (s *otlpSink) Close() error {
+	return nil
+}
+
+// observe adds a test duration to the cumulative histogram
+func (s *otlpSink) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(otlpDurationBounds, seconds)
+	s.bucketCounts[i]++
+	s.count++
+	s.sum += seconds
+}
+
+// encode builds an ExportMetricsServiceRequest for the result
+func (s *otlpSink) encode(res results) []byte {
+	tags := resultTags(res)
+	fields := resultFields(res)
+
+	serverAttrs := map[string]string{}
+	pointAttrs := map[string]string{}
+	for k, v := range tags {
+		if strings.HasPrefix(k, "server_") && s.resourceAttributes {
+			serverAttrs[k] = v
+		} else {
+			pointAttrs[k] = v
+		}
+	}
+
+	resourceAttrs := map[string]string{
+		"service.name":    "speedtest-to-influxdb",
+		"service.version": Version,
+	}
+	for k, v := range serverAttrs {
+		resourceAttrs[k] = v
+	}
+
+	now := uint64(res.timestamp.UnixNano())
+
+	var req protoBuffer
+	req.messageField(1, func(rm *protoBuffer) {
+		rm.messageField(1, func(r *protoBuffer) {
+			appendKeyValues(r, 1, resourceAttrs)
+		})
+		rm.messageField(2, func(sm *protoBuffer) {
+			sm.messageField(1, func(scope *protoBuffer) {
+				scope.stringField(1, "speedtest-to-influxdb")
+				scope.stringField(2, Version)
+			})
+
+			for _, g := range otlpGauges {
+				value, ok := fields[g.field].(float64)
+				if !ok {
+					continue
+				}
+
+				sm.messageField(2, func(m *protoBuffer) {
+					m.stringField(1, g.name)
+					m.stringField(2, g.help)
+					m.stringField(3, g.unit)
+					m.messageField(5, func(gauge *protoBuffer) {
+						gauge.messageField(1, func(dp *protoBuffer) {
+							dp.fixed64Field(3, now)
+							dp.doubleField(4, value)
+							appendKeyValues(dp, 7, pointAttrs)
+						})
+					})
+				})
+			}
+
+			sm.messageField(2, func(m *protoBuffer) {
+				m.stringField(1, "speedtest.duration")
+				m.stringField(2, "Time taken by a speedtest run.")
+				m.stringField(3, "s")
+				m.messageField(9, func(h *protoBuffer) {
+					h.messageField(1, func(dp *protoBuffer) {
+						dp.fixed64Field(2, uint64(s.start.UnixNano()))
+						dp.fixed64Field(3, now)
+						dp.fixed64Field(4, s.count)
+						dp.doubleField(5, s.sum)
+						dp.messageField(6, func(packed *protoBuffer) {
+							for _, n := range s.bucketCounts {
+								binary.Write(packedWriter{packed}, binary.LittleEndian, n)
+							}
+						})
+						dp.messageField(7, func(packed *protoBuffer) {
+							for _, b := range otlpDurationBounds {
+								binary.Write(packedWriter{packed}, binary.LittleEndian, b)
+							}
+						})
+					})
+					// cumulative temporality
+					h.int64Field(2, 2)
+				})
+			})
+		})
+	})
+
+	return req.buf
+}
+
+// packedWriter appends raw bytes to a protoBuffer, for packed repeated fields
+type packedWriter struct {
+	p *protoBuffer
+}
+
+func (w packedWriter) Write(b []byte) (int, error) {
+	w.p.buf = append(w.p.buf, b...)
+	return len(b), nil
+}
+
+// appendKeyValues adds string attributes as KeyValue messages, sorted by key
+func appendKeyValues(p *protoBuffer, field int, attrs map[string]string) {
+	var keys []string
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		p.messageField(field, func(kv *protoBuffer) {
+			kv.stringField(1, k)
+			kv.messageField(2, func(v *protoBuffer) {
+				v.stringField(1, attrs[k])
+			})
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseKeyValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"pairs", "api-key=abc123, Authorization=Basic%20dXNlcg==", map[string]string{"api-key": "abc123", "Authorization": "Basic dXNlcg=="}, false},
+		{"missing value", "api-key", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKeyValues(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKeyValues() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseKeyValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_otlpSink_observe(t *testing.T) {
+	s := &otlpSink{bucketCounts: make([]uint64, len(otlpDurationBounds)+1)}
+	for _, d := range []time.Duration{3 * time.Second, 5 * time.Second, 42 * time.Second, 10 * time.Minute} {
+		s.observe(d)
+	}
+
+	want := []uint64{2, 0, 0, 0, 1, 0, 0, 0, 0, 0, 1}
+	if !reflect.DeepEqual(s.bucketCounts, want) {
+		t.Errorf("bucketCounts = %v, want %v", s.bucketCounts, want)
+	}
+	if s.count != 4 || s.sum != 650 {
+		t.Errorf("count = %d, sum = %v, want 4 and 650", s.count, s.sum)
+	}
+}
+
+func Test_otlpSink_WriteResult(t *testing.T) {
+	res := results{latency: floatPtr(9.5), timestamp: time.Unix(1525500000, 0), duration: 42 * time.Second}
+
+	tests := []struct {
+		name string
+		grpc bool
+		h2c  bool
+	}{
+		{"http/protobuf", false, false},
+		{"grpc", true, false},
+		{"grpc without tls", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotReq *http.Request
+			var gotBody []byte
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotReq = r
+				gotBody, _ = ioutil.ReadAll(r.Body)
+				if tt.grpc {
+					w.Header().Set("Trailer", "Grpc-Status")
+					w.Header().Set("Content-Type", "application/grpc")
+					w.Write([]byte{0, 0, 0, 0, 0})
+					w.Header().Set("Grpc-Status", "0")
+				}
+			}))
+			httpClient := newOTLPClient(true, nil)
+			if tt.h2c {
+				srv.Config.Protocols = new(http.Protocols)
+				srv.Config.Protocols.SetUnencryptedHTTP2(true)
+				srv.Start()
+			} else {
+				srv.EnableHTTP2 = true
+				srv.StartTLS()
+				httpClient = srv.Client()
+			}
+			defer srv.Close()
+
+			s := &otlpSink{
+				url:          srv.URL + "/v1/metrics",
+				grpc:         tt.grpc,
+				headers:      map[string]string{"api-key": "abc123"},
+				httpClient:   httpClient,
+				bucketCounts: make([]uint64, len(otlpDurationBounds)+1),
+			}
+			if err := s.WriteResult(res); err != nil {
+				t.Fatalf("otlpSink.WriteResult() error = %v", err)
+			}
+
+			if got := gotReq.Header.Get("api-key"); got != "abc123" {
+				t.Errorf("api-key header = %v, want abc123", got)
+			}
+
+			body := gotBody
+			if tt.grpc {
+				if gotReq.ProtoMajor != 2 || gotReq.Header.Get("Content-Type") != "application/grpc" {
+					t.Errorf("got %s %s, want grpc over HTTP/2", gotReq.Proto, gotReq.Header.Get("Content-Type"))
+				}
+				if n := binary.BigEndian.Uint32(body[1:5]); body[0] != 0 || int(n) != len(body)-5 {
+					t.Fatalf("grpc frame header = % x, want an uncompressed %d byte message", body[:5], len(body)-5)
+				}
+				body = body[5:]
+			}
+
+			if want := s.encode(res); !reflect.DeepEqual(body, want) {
+				t.Errorf("body isn't the encoded export request")
+			}
+		})
+	}
+}
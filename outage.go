@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/kylegrantlucas/speedtest"
+	"github.com/urfave/cli"
+)
+
+// outage event kinds, written as the event tag
+const (
+	outageStart = "start"
+	outageEnd   = "end"
+)
+
+type outageEvent struct {
+	kind     string
+	start    time.Time
+	end      time.Time
+	downtime time.Duration
+}
+
+// outageDetector tracks consecutive connectivity failures, an outage starts
+// once threshold cycles in a row fail and ends at the first successful probe.
+// Downtime is only cumulative since the process started unless it's kept in
+// a state file.
+type outageDetector struct {
+	threshold   int
+	path        string
+	consecutive int
+	firstFailed time.Time
+	start       time.Time
+	active      bool
+	downtime    time.Duration
+}
+
+// outageState is what's persisted between runs, including an outage that
+// was still ongoing when the daemon stopped
+type outageState struct {
+	DowntimeSeconds float64    `json:"downtime_seconds"`
+	Start           *time.Time `json:"start,omitempty"`
+}
+
+func newOutageDetector(threshold int, path string) (*outageDetector, error) {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	o := &outageDetector{threshold: threshold, path: path}
+	if path == "" {
+		return o, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading outage state: %v", err)
+	}
+
+	var state outageState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding outage state %s: %v", path, err)
+	}
+
+	o.downtime = time.Duration(state.DowntimeSeconds * float64(time.Second))
+	if state.Start != nil {
+		o.active, o.start = true, *state.Start
+	}
+
+	return o, nil
+}
+
+// connectivityFailure reports whether the cycle failed before reaching any
+// speedtest server, download and upload failures don't count as outages
+func connectivityFailure(res results) bool {
+	return res.failedPhase == phaseConfig || res.failedPhase == phaseServer
+}
+
+// record feeds a cycle outcome to the detector, returning an event when an
+// outage starts or ends
+func (o *outageDetector) record(failed bool, at time.Time) *outageEvent {
+	if !failed {
+		o.consecutive = 0
+		if !o.active {
+			return nil
+		}
+
+		o.active = false
+		o.downtime += at.Sub(o.start)
+		o.save()
+		return &outageEvent{kind: outageEnd, start: o.start, end: at, downtime: o.downtime}
+	}
+
+	if o.consecutive == 0 {
+		o.firstFailed = at
+	}
+	o.consecutive++
+
+	if o.active || o.consecutive < o.threshold {
+		return nil
+	}
+
+	// the outage is backdated to the first failure in the run
+	o.active = true
+	o.start = o.firstFailed
+	o.save()
+	return &outageEvent{kind: outageStart, start: o.start, downtime: o.downtime}
+}
+
+// save persists the downtime and any ongoing outage when there's a state
+// file, a failure is only logged as it mustn't stop the outage being recorded
+func (o *outageDetector) save() {
+	if o.path == "" {
+		return
+	}
+
+	state := outageState{DowntimeSeconds: o.downtime.Seconds()}
+	if o.active {
+		state.Start = &o.start
+	}
+
+	b, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomic(o.path, b)
+	}
+	if err != nil {
+		log.Printf("error saving outage state: %v", err)
+	}
+}
+
+// duration is how long the outage lasted, zero for start events
+func (ev outageEvent) duration() time.Duration {
+	if ev.kind != outageEnd {
+		return 0
+	}
+
+	return ev.end.Sub(ev.start)
+}
+
+// probeConnectivity checks that a speedtest server can be selected without
+// running the download and upload tests
+func probeConnectivity(c *cli.Context, client *speedtest.Client) (*speedtest.Client, error) {
+	if client == nil {
+		var err error
+		client, err = newSpeedtestClient()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := client.GetServer(c.String("server"))
+	return client, err
+}
+
+// event converts the outage event for writing to the sinks
+func (ev outageEvent) event() event {
+	at := ev.start
+	if ev.kind == outageEnd {
+		at = ev.end
+	}
+
+	return event{
+		name: "speedtest_outage",
+		tags: map[string]string{
+			"event": ev.kind,
+		},
+		fields: map[string]interface{}{
+			"duration_seconds": ev.duration().Seconds(),
+			"downtime_seconds": ev.downtime.Seconds(),
+		},
+		at: at,
+	}
+}
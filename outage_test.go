@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_outageDetector_record(t *testing.T) {
+	base := time.Date(2018, 5, 5, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return base.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	type step struct {
+		failed    bool
+		at        time.Time
+		wantKind  string
+		wantStart time.Time
+	}
+	tests := []struct {
+		name         string
+		threshold    int
+		steps        []step
+		wantDowntime time.Duration
+	}{
+		{
+			name:      "single failure below threshold",
+			threshold: 2,
+			steps: []step{
+				{failed: true, at: at(0)},
+				{failed: false, at: at(20)},
+			},
+		},
+		{
+			name:      "outage starts at threshold and ends on success",
+			threshold: 2,
+			steps: []step{
+				{failed: true, at: at(0)},
+				{failed: true, at: at(20), wantKind: outageStart, wantStart: at(0)},
+				{failed: true, at: at(21)},
+				{failed: false, at: at(30), wantKind: outageEnd},
+			},
+			wantDowntime: 30 * time.Minute,
+		},
+		{
+			name:      "downtime accumulates across outages",
+			threshold: 1,
+			steps: []step{
+				{failed: true, at: at(0), wantKind: outageStart},
+				{failed: false, at: at(5), wantKind: outageEnd},
+				{failed: true, at: at(20), wantKind: outageStart},
+				{failed: false, at: at(30), wantKind: outageEnd},
+			},
+			wantDowntime: 15 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := newOutageDetector(tt.threshold, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, s := range tt.steps {
+				ev := o.record(s.failed, s.at)
+				gotKind := ""
+				if ev != nil {
+					gotKind = ev.kind
+				}
+				if gotKind != s.wantKind {
+					t.Fatalf("step %d: outageDetector.record() kind = %q, want %q", i, gotKind, s.wantKind)
+				}
+				if !s.wantStart.IsZero() && !ev.start.Equal(s.wantStart) {
+					t.Errorf("step %d: outage start = %v, want %v", i, ev.start, s.wantStart)
+				}
+			}
+			if o.downtime != tt.wantDowntime {
+				t.Errorf("outageDetector.downtime = %v, want %v", o.downtime, tt.wantDowntime)
+			}
+		})
+	}
+}
+
+func Test_outageDetector_persists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "outage.json")
+	base := time.Date(2018, 5, 5, 12, 0, 0, 0, time.UTC)
+
+	o, err := newOutageDetector(1, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.record(true, base)
+	o.record(false, base.Add(10*time.Minute))
+	o.record(true, base.Add(20*time.Minute))
+
+	// a restart mid-outage picks up the downtime and the ongoing outage
+	o, err = newOutageDetector(1, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.active || !o.start.Equal(base.Add(20*time.Minute)) {
+		t.Fatalf("restored outage active = %v, start = %v, want ongoing from %v", o.active, o.start, base.Add(20*time.Minute))
+	}
+
+	ev := o.record(false, base.Add(25*time.Minute))
+	if ev == nil || ev.kind != outageEnd {
+		t.Fatalf("outageDetector.record() = %+v, want an end event", ev)
+	}
+	if ev.downtime != 15*time.Minute {
+		t.Errorf("downtime = %v, want %v", ev.downtime, 15*time.Minute)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/urfave/cli"
+)
+
+var planFlags = []cli.Flag{
+	cli.Float64Flag{
+		Name:  "plan-download",
+		Usage: "The advertised download speed in Mbit/s, adds download_pct_of_plan to results",
+	},
+	cli.Float64Flag{
+		Name:  "plan-upload",
+		Usage: "The advertised upload speed in Mbit/s, adds upload_pct_of_plan to results",
+	},
+	cli.Float64Flag{
+		Name:  "plan-latency",
+		Usage: "The most latency in ms the plan allows, used by the compliance report",
+	},
+	cli.Float64Flag{
+		Name:  "plan-min-pct",
+		Value: 80,
+		Usage: "The percentage of the advertised speeds a test must reach to meet the plan",
+	},
+}
+
+// plan is the contracted service, zero values aren't part of the contract
+type plan struct {
+	download float64
+	upload   float64
+	latency  float64
+	minPct   float64
+}
+
+// planFromFlags reads the plan from the global flags, so subcommands see it
+// too
+func planFromFlags(c *cli.Context) plan {
+	return plan{
+		download: c.GlobalFloat64("plan-download"),
+		upload:   c.GlobalFloat64("plan-upload"),
+		latency:  c.GlobalFloat64("plan-latency"),
+		minPct:   c.GlobalFloat64("plan-min-pct"),
+	}
+}
+
+// pctOf returns measured as a percentage of advertised, if both are known
+func pctOf(measured *float64, advertised float64) (float64, bool) {
+	if measured == nil || advertised <= 0 {
+		return 0, false
+	}
+
+	return *measured / advertised * 100, true
+}
+
+// meetsDownload reports whether the result reached enough of the advertised
+// download speed, a missing measurement doesn't
+func (p plan) meetsDownload(res results) bool {
+	pct, ok := pctOf(res.download, p.download)
+	return ok && pct >= p.minPct
+}
+
+func (p plan) meetsUpload(res results) bool {
+	pct, ok := pctOf(res.upload, p.upload)
+	return ok && pct >= p.minPct
+}
+
+func (p plan) meetsLatency(res results) bool {
+	return res.latency != nil && *res.latency <= p.latency
+}
+
+// meets reports whether the result met every part of the plan that's set
+func (p plan) meets(res results) bool {
+	return (p.download <= 0 || p.meetsDownload(res)) &&
+		(p.upload <= 0 || p.meetsUpload(res)) &&
+		(p.latency <= 0 || p.meetsLatency(res))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+	"github.com/urfave/cli"
+)
+
+var postgresFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "postgres-url",
+		Usage:  "Write results to this PostgreSQL connection string, which must be reachable at startup to create the tables, disabled when empty",
+		EnvVar: "POSTGRES_URL",
+	},
+	cli.StringFlag{
+		Name:  "postgres-schema",
+		Value: "speedtest",
+		Usage: "The schema to create the results and servers tables in",
+	},
+}
+
+// postgresSink writes each result as a row, with the server metadata kept
+// once per server in its own table
+type postgresSink struct {
+	db           *sql.DB
+	upsertServer *sql.Stmt
+	insertResult *sql.Stmt
+}
+
+func newPostgresSink(c *cli.Context) (sink, error) {
+	if c.String("postgres-url") == "" {
+		return nil, nil
+	}
+
+	db, err := sql.Open("postgres", c.String("postgres-url"))
+	if err != nil {
+		return nil, fmt.Errorf("error opening postgres: %v", err)
+	}
+
+	s, err := setupPostgres(db, c.String("postgres-schema"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// setupPostgres creates the schema if it's missing, turning the results table
+// into a hypertable when timescaleDB is installed, and prepares the inserts
+func setupPostgres(db *sql.DB, schema string) (*postgresSink, error) {
+	var timescale bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&timescale)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to postgres: %v", err)
+	}
+
+	for _, stmt := range postgresSchema(schema, timescale) {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			return nil, fmt.Errorf("error creating postgres schema: %v", err)
+		}
+	}
+	if timescale {
+		log.Printf("writing postgres results to a timescaleDB hypertable")
+	}
+
+	servers, results := postgresTables(schema)
+	s := &postgresSink{db: db}
+
+	s.upsertServer, err = db.Prepare(`INSERT INTO ` + servers + ` (server_id, name, sponsor, url, country, cc, lat, lon, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (server_id) DO UPDATE SET
+			name = EXCLUDED.name, sponsor = EXCLUDED.sponsor, url = EXCLUDED.url, country = EXCLUDED.country,
+			cc = EXCLUDED.cc, lat = EXCLUDED.lat, lon = EXCLUDED.lon, updated_at = EXCLUDED.updated_at`)
+	if err != nil {
+		return nil, err
+	}
+
+	s.insertResult, err = db.Prepare(`INSERT INTO ` + results + ` (
+		time, duration_seconds, status, failed_phase, error, latency, download, upload,
+		server_id, server_distance, client_ip, client_isp, client_lat, client_lon
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`)
+	if err != nil {
+		s.upsertServer.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// postgresTables returns the quoted names of the servers and results tables
+func postgresTables(schema string) (string, string) {
+	quoted := pq.QuoteIdentifier(schema)
+	return quoted + ".servers", quoted + ".results"
+}
+
+// postgresSchema is the DDL for the tables, safe to run on every start
+func postgresSchema(schema string, timescale bool) []string {
+	servers, results := postgresTables(schema)
+
+	stmts := []string{
+		`CREATE SCHEMA IF NOT EXISTS ` + pq.QuoteIdentifier(schema),
+		`CREATE TABLE IF NOT EXISTS ` + servers + ` (
+			server_id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			sponsor TEXT NOT NULL,
+			url TEXT NOT NULL,
+			country TEXT NOT NULL,
+			cc TEXT NOT NULL,
+			lat DOUBLE PRECISION NOT NULL,
+			lon DOUBLE PRECISION NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + results + ` (
+			time TIMESTAMPTZ NOT NULL,
+			duration_seconds DOUBLE PRECISION NOT NULL,
+			status TEXT NOT NULL,
+			failed_phase TEXT,
+			error TEXT,
+			latency DOUBLE PRECISION,
+			download DOUBLE PRECISION,
+			upload DOUBLE PRECISION,
+			server_id TEXT REFERENCES ` + servers + ` (server_id),
+			server_distance DOUBLE PRECISION,
+			client_ip TEXT,
+			client_isp TEXT,
+			client_lat DOUBLE PRECISION,
+			client_lon DOUBLE PRECISION
+		)`,
+	}
+
+	// a hypertable gets its own time index
+	if timescale {
+		stmts = append(stmts, `SELECT create_hypertable(`+pq.QuoteLiteral(results)+`, 'time', if_not_exists => TRUE, migrate_data => TRUE)`)
+	} else {
+		stmts = append(stmts, `CREATE INDEX IF NOT EXISTS results_time_idx ON `+results+` (time DESC)`)
+	}
+
+	return stmts
+}
+
+func (s *postgresSink) Name() string {
+	return "postgres"
+}
+
+func (s *postgresSink) WriteResult(res results) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if res.server.ID != "" {
+		_, err = tx.Stmt(s.upsertServer).Exec(postgresServerArgs(res)...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Stmt(s.insertResult).Exec(postgresResultArgs(res)...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func postgresServerArgs(res results) []interface{} {
+	server := res.server
+	return []interface{}{
+		server.ID, server.Name, server.Sponsor, server.URL, server.Country, server.CC,
+		server.Lat, server.Lon, res.timestamp.UTC(),
+	}
+}
+
+// postgresResultArgs are the insert parameters, with NULL for whatever wasn't
+// measured
+func postgresResultArgs(res results) []interface{} {
+	var failedPhase, errText, serverID, distance, clientIP, clientISP, clientLat, clientLon interface{}
+	if res.failedPhase != "" {
+		failedPhase = res.failedPhase
+	}
+	if res.err != nil {
+		errText = res.err.Error()
+	}
+	if res.server.ID != "" {
+		serverID, distance = res.server.ID, res.server.Distance
+	}
+	if res.client.IP != "" {
+		clientIP, clientISP, clientLat, clientLon = res.client.IP, res.client.Isp, res.client.Lat, res.client.Lon
+	}
+
+	return []interface{}{
+		res.timestamp.UTC(), res.duration.Seconds(), res.status(), failedPhase, errText,
+		nullFloat(res.latency), nullFloat(res.download), nullFloat(res.upload),
+		serverID, distance, clientIP, clientISP, clientLat, clientLon,
+	}
+}
+
+func (s *postgresSink) Close() error {
+	s.upsertServer.Close()
+	s.insertResult.Close()
+	return s.db.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_postgresResultArgs(t *testing.T) {
+	at := time.Unix(1500000000, 0)
+	tests := []struct {
+		name string
+		res  results
+		want []interface{}
+	}{
+		{
+			name: "complete results",
+			res: results{
+				server:    testServer,
+				client:    testClient,
+				latency:   floatPtr(9.5),
+				download:  floatPtr(94.2),
+				upload:    floatPtr(11.7),
+				timestamp: at,
+				duration:  42 * time.Second,
+			},
+			want: []interface{}{
+				at.UTC(), 42.0, "ok", nil, nil, 9.5, 94.2, 11.7,
+				"1234", 12.5, "203.0.113.7", "Example Broadband", 39.8, -89.64,
+			},
+		},
+		{
+			name: "failed before selecting a server",
+			res: results{
+				failedPhase: phaseConfig,
+				err:         errors.New("no route to host"),
+				timestamp:   at,
+				duration:    time.Second,
+			},
+			want: []interface{}{
+				at.UTC(), 1.0, "failed", "config", "no route to host", nil, nil, nil,
+				nil, nil, nil, nil, nil, nil,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postgresResultArgs(tt.res); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("postgresResultArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_postgresSchema(t *testing.T) {
+	tests := []struct {
+		name      string
+		timescale bool
+		want      string
+	}{
+		{"plain postgres", false, `CREATE INDEX IF NOT EXISTS results_time_idx ON "speed""test".results (time DESC)`},
+		{"timescaleDB", true, `SELECT create_hypertable('"speed""test".results', 'time', if_not_exists => TRUE, migrate_data => TRUE)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmts := postgresSchema(`speed"test`, tt.timescale)
+			if got := stmts[len(stmts)-1]; got != tt.want {
+				t.Errorf("postgresSchema() last statement = %s, want %s", got, tt.want)
+			}
+			if !strings.Contains(stmts[2], `REFERENCES "speed""test".servers (server_id)`) {
+				t.Errorf("postgresSchema() results table doesn't reference servers: %s", stmts[2])
+			}
+		})
+	}
+}
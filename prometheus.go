@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var prometheusFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "prometheus-listen",
+		Usage: "Serve prometheus metrics on /metrics at this address, e.g. :9516, disabled when empty",
+	},
+}
+
+// gauge is the last value of a metric along with the labels of the result it
+// came from
+type gauge struct {
+	value  float64
+	labels map[string]string
+}
+
+// prometheusSink keeps the latest results in memory and serves them in the
+// prometheus text exposition format
+type prometheusSink struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	gauges      map[string]gauge
+	runs        map[string]float64
+	failures    map[string]float64
+	lastSuccess time.Time
+	sinks       map[string]sinkHealth
+}
+
+// prometheusGauges maps the result fields to the exported gauges
+var prometheusGauges = []struct {
+	field string
+	name  string
+	help  string
+}{
+	{"latency", "speedtest_latency_milliseconds", "Latency to the speedtest server in the last run."},
+	{"download", "speedtest_download_megabits_per_second", "Download speed in the last run."},
+	{"upload", "speedtest_upload_megabits_per_second", "Upload speed in the last run."},
+	{"server_distance", "speedtest_server_distance_kilometers", "Distance to the speedtest server in the last run."},
+}
+
+func newPrometheusSink(c *cli.Context) (sink, error) {
+	if c.String("prometheus-listen") == "" {
+		return nil, nil
+	}
+
+	l, err := net.Listen("tcp", c.String("prometheus-listen"))
+	if err != nil {
+		return nil, fmt.Errorf("error listening for prometheus: %v", err)
+	}
+
+	s := &prometheusSink{
+		listener: l,
+		gauges:   map[string]gauge{},
+		runs:     map[string]float64{},
+		failures: map[string]float64{},
+		sinks:    map[string]sinkHealth{},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s)
+	go func() {
+		err := http.Serve(l, mux)
+		if err != nil {
+			log.Printf("prometheus listener stopped: %v", err)
+		}
+	}()
+
+	log.Printf("serving prometheus metrics on %s/metrics", l.Addr())
+	return s, nil
+}
+
+func (s *prometheusSink) Name() string {
+	return "prometheus"
+}
+
+func (s *prometheusSink) WriteResult(res results) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.runs[res.status()]++
+	if res.failedPhase != "" {
+		s.failures[res.failedPhase]++
+	}
+	if res.status() == statusOK {
+		s.lastSuccess = res.timestamp
+	}
+
+	// the server labels are the influxDB tags minus the per-run ones
+	labels := resultTags(res)
+	delete(labels, "status")
+	delete(labels, "failed_phase")
+
+	// a value the run didn't measure is dropped rather than left showing
+	// the previous run's
+	fields := resultFields(res)
+	for _, g := range prometheusGauges {
+		if v, ok := fields[g.field].(float64); ok {
+			s.gauges[g.name] = gauge{value: v, labels: labels}
+		} else {
+			delete(s.gauges, g.name)
+		}
+	}
+
+	return nil
+}
+
+// WriteEvent keeps the health of each sink, other events aren't exported
+func (s *prometheusSink) WriteEvent(ev event) error {
+	if ev.name != "speedtest_sink_health" {
+		return nil
+	}
+
+	h := sinkHealth{name: ev.tags["sink"]}
+	h.healthy, _ = ev.fields["healthy"].(bool)
+	h.failures, _ = ev.fields["failures"].(int)
+	h.dropped, _ = ev.fields["dropped"].(int)
+
+	s.mu.Lock()
+	s.sinks[h.name] = h
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *prometheusSink) Close() error {
+	return s.listener.Close()
+}
+
+func (s *prometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	s.writeMetrics(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+func (s *prometheusSink) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, g := range prometheusGauges {
+		v, ok := s.gauges[g.name]
+		if !ok {
+			continue
+		}
+		writeMetricHeader(w, g.name, g.help, "gauge")
+		writeSample(w, g.name, v.labels, v.value)
+	}
+
+	writeMetricHeader(w, "speedtest_runs_total", "Speedtest runs by result status.", "counter")
+	for _, status := range []string{statusOK, statusPartial, statusFailed} {
+		writeSample(w, "speedtest_runs_total", map[string]string{"status": status}, s.runs[status])
+	}
+
+	writeMetricHeader(w, "speedtest_failures_total", "Speedtest runs that failed, by the phase that failed.", "counter")
+	for _, phase := range []string{phaseConfig, phaseServer, phaseDownload, phaseUpload} {
+		writeSample(w, "speedtest_failures_total", map[string]string{"phase": phase}, s.failures[phase])
+	}
+
+	if !s.lastSuccess.IsZero() {
+		writeMetricHeader(w, "speedtest_last_success_timestamp_seconds", "Unix time of the last run that measured every value.", "gauge")
+		writeSample(w, "speedtest_last_success_timestamp_seconds", nil, float64(s.lastSuccess.Unix()))
+	}
+
+	if len(s.sinks) == 0 {
+		return
+	}
+
+	var names []string
+	for name := range s.sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeMetricHeader(w, "speedtest_sink_healthy", "Whether the last write to the output sink succeeded.", "gauge")
+	for _, name := range names {
+		healthy := 0.0
+		if s.sinks[name].healthy {
+			healthy = 1
+		}
+		writeSample(w, "speedtest_sink_healthy", map[string]string{"sink": name}, healthy)
+	}
+
+	writeMetricHeader(w, "speedtest_sink_failures_total", "Writes to the output sink that failed.", "counter")
+	for _, name := range names {
+		writeSample(w, "speedtest_sink_failures_total", map[string]string{"sink": name}, float64(s.sinks[name].failures))
+	}
+
+	writeMetricHeader(w, "speedtest_sink_dropped_total", "Writes dropped because the output sink fell behind.", "counter")
+	for _, name := range names {
+		writeSample(w, "speedtest_sink_dropped_total", map[string]string{"sink": name}, float64(s.sinks[name].dropped))
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name string, labels map[string]string, value float64) {
+	fmt.Fprintf(w, "%s%s %v\n", name, formatLabels(labels), value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders labels sorted by name so the output is stable
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(labels[name])))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
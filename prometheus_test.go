@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_prometheusSink_writeMetrics(t *testing.T) {
+	s := &prometheusSink{
+		gauges:   map[string]gauge{},
+		runs:     map[string]float64{},
+		failures: map[string]float64{},
+		sinks:    map[string]sinkHealth{},
+	}
+
+	s.WriteResult(results{
+		failedPhase: phaseServer,
+		err:         errors.New("no such host"),
+		timestamp:   time.Unix(1525498800, 0),
+	})
+	s.WriteResult(results{
+		server:    testServer,
+		latency:   floatPtr(9.5),
+		download:  floatPtr(100),
+		upload:    floatPtr(20),
+		timestamp: time.Unix(1525500000, 0),
+	})
+
+	at := time.Unix(1525501200, 0)
+	s.WriteEvent(sinkHealth{name: "influxdb", failures: 3, dropped: 1, lastError: "connection refused"}.event(at))
+	s.WriteEvent(sinkHealth{name: "file", healthy: true, lastSuccess: at}.event(at))
+	s.WriteEvent(outageEvent{kind: outageStart, start: at}.event())
+
+	var b bytes.Buffer
+	s.writeMetrics(&b)
+
+	labels := `{server_country="United States",server_id="1234",server_name="Springfield",server_sponsor="Example ISP",server_url="http://speedtest.example.com/speedtest/upload.php"}`
+	want := `# HELP speedtest_latency_milliseconds Latency to the speedtest server in the last run.
+# TYPE speedtest_latency_milliseconds gauge
+speedtest_latency_milliseconds` + labels + ` 9.5
+# HELP speedtest_download_megabits_per_second Download speed in the last run.
+# TYPE speedtest_download_megabits_per_second gauge
+speedtest_download_megabits_per_second` + labels + ` 100
+# HELP speedtest_upload_megabits_per_second Upload speed in the last run.
+# TYPE speedtest_upload_megabits_per_second gauge
+speedtest_upload_megabits_per_second` + labels + ` 20
+# HELP speedtest_server_distance_kilometers Distance to the speedtest server in the last run.
+# TYPE speedtest_server_distance_kilometers gauge
+speedtest_server_distance_kilometers` + labels + ` 12.5
+# HELP speedtest_runs_total Speedtest runs by result status.
+# TYPE speedtest_runs_total counter
+speedtest_runs_total{status="ok"} 1
+speedtest_runs_total{status="partial"} 0
+speedtest_runs_total{status="failed"} 1
+# HELP speedtest_failures_total Speedtest runs that failed, by the phase that failed.
+# TYPE speedtest_failures_total counter
+speedtest_failures_total{phase="config"} 0
+speedtest_failures_total{phase="server"} 1
+speedtest_failures_total{phase="download"} 0
+speedtest_failures_total{phase="upload"} 0
+# HELP speedtest_last_success_timestamp_seconds Unix time of the last run that measured every value.
+# TYPE speedtest_last_success_timestamp_seconds gauge
+speedtest_last_success_timestamp_seconds 1.5255e+09
+# HELP speedtest_sink_healthy Whether the last write to the output sink succeeded.
+# TYPE speedtest_sink_healthy gauge
+speedtest_sink_healthy{sink="file"} 1
+speedtest_sink_healthy{sink="influxdb"} 0
+# HELP speedtest_sink_failures_total Writes to the output sink that failed.
+# TYPE speedtest_sink_failures_total counter
+speedtest_sink_failures_total{sink="file"} 0
+speedtest_sink_failures_total{sink="influxdb"} 3
+# HELP speedtest_sink_dropped_total Writes dropped because the output sink fell behind.
+# TYPE speedtest_sink_dropped_total counter
+speedtest_sink_dropped_total{sink="file"} 0
+speedtest_sink_dropped_total{sink="influxdb"} 1
+`
+	if got := b.String(); got != want {
+		t.Errorf("prometheusSink.writeMetrics() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func Test_formatLabels(t *testing.T) {
+	got := formatLabels(map[string]string{"b": `say "hi"`, "a": `C:\path`})
+	want := `{a="C:\\path",b="say \"hi\""}`
+	if got != want {
+		t.Errorf("formatLabels() = %v, want %v", got, want)
+	}
+}
+
+func Test_prometheusSink_WriteResult_dropsUnmeasured(t *testing.T) {
+	s := &prometheusSink{
+		gauges:   map[string]gauge{},
+		runs:     map[string]float64{},
+		failures: map[string]float64{},
+		sinks:    map[string]sinkHealth{},
+	}
+
+	s.WriteResult(results{server: testServer, latency: floatPtr(9.5), download: floatPtr(100), upload: floatPtr(20)})
+	s.WriteResult(results{server: testServer, latency: floatPtr(12), download: floatPtr(80), failedPhase: phaseUpload})
+
+	if g, ok := s.gauges["speedtest_download_megabits_per_second"]; !ok || g.value != 80 {
+		t.Errorf("download gauge = %+v, want the partial run's 80", g)
+	}
+	if g, ok := s.gauges["speedtest_upload_megabits_per_second"]; ok {
+		t.Errorf("upload gauge = %+v, want it dropped as the run didn't measure it", g)
+	}
+
+	s.WriteResult(results{failedPhase: phaseServer, err: errors.New("no such host")})
+	if len(s.gauges) != 0 {
+		t.Errorf("gauges after a failed run = %v, want none", s.gauges)
+	}
+}
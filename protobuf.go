@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// protoBuffer hand-encodes the few protobuf messages the push sinks send,
+// which saves vendoring a protobuf runtime for a handful of fields
+type protoBuffer struct {
+	buf []byte
+}
+
+func (p *protoBuffer) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	p.buf = append(p.buf, b[:n]...)
+}
+
+func (p *protoBuffer) key(field int, wireType int) {
+	p.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (p *protoBuffer) bytesField(field int, b []byte) {
+	p.key(field, wireBytes)
+	p.varint(uint64(len(b)))
+	p.buf = append(p.buf, b...)
+}
+
+func (p *protoBuffer) stringField(field int, s string) {
+	p.bytesField(field, []byte(s))
+}
+
+// messageField embeds a message encoded by fn
+func (p *protoBuffer) messageField(field int, fn func(m *protoBuffer)) {
+	var m protoBuffer
+	fn(&m)
+	p.bytesField(field, m.buf)
+}
+
+func (p *protoBuffer) int64Field(field int, v int64) {
+	p.key(field, wireVarint)
+	p.varint(uint64(v))
+}
+
+func (p *protoBuffer) doubleField(field int, v float64) {
+	p.fixed64Field(field, math.Float64bits(v))
+}
+
+func (p *protoBuffer) fixed64Field(field int, v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	p.key(field, wireFixed64)
+	p.buf = append(p.buf, b[:]...)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var remoteWriteFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "remote-write-url",
+		Usage: "Push results to this prometheus remote_write endpoint, disabled when empty",
+	},
+	cli.StringFlag{
+		Name:  "remote-write-username",
+		Usage: "The username for remote_write basic auth",
+	},
+	cli.StringFlag{
+		Name:   "remote-write-password",
+		Usage:  "The password for remote_write basic auth",
+		EnvVar: "REMOTE_WRITE_PASSWORD",
+	},
+	cli.StringFlag{
+		Name:   "remote-write-bearer-token",
+		Usage:  "The bearer token for remote_write auth, used instead of basic auth",
+		EnvVar: "REMOTE_WRITE_BEARER_TOKEN",
+	},
+}
+
+// remoteWriteSink pushes each result with the prometheus remote_write
+// protocol, for probes nothing can scrape
+type remoteWriteSink struct {
+	url         string
+	username    string
+	password    string
+	bearerToken string
+	httpClient  *http.Client
+}
+
+func newRemoteWriteSink(c *cli.Context) (sink, error) {
+	if c.String("remote-write-url") == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(c.String("remote-write-url"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote_write url: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported remote_write url scheme %q", u.Scheme)
+	}
+
+	return &remoteWriteSink{
+		url:         u.String(),
+		username:    c.String("remote-write-username"),
+		password:    c.String("remote-write-password"),
+		bearerToken: c.String("remote-write-bearer-token"),
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *remoteWriteSink) Name() string {
+	return "remote_write"
+}
+
+func (s *remoteWriteSink) WriteResult(res results) error {
+	body := encodeSnappy(encodeWriteRequest(res))
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "speedtest-to-influxdb")
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearerToken)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("remote_write returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+func (s *remoteWriteSink) Close() error {
+	return nil
+}
+
+// encodeWriteRequest builds a remote_write WriteRequest with a series per
+// numeric influxDB field, named speedtest_<field> and labelled with the
+// influxDB tags
+func encodeWriteRequest(res results) []byte {
+	tags := resultTags(res)
+	fields := resultFields(res)
+
+	var names []string
+	for name, v := range fields {
+		if _, ok := v.(float64); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	timestamp := res.timestamp.UnixNano() / int64(time.Millisecond)
+
+	var req protoBuffer
+	for _, name := range names {
+		labels := map[string]string{"__name__": "speedtest_" + name}
+		for k, v := range tags {
+			labels[k] = v
+		}
+
+		value := fields[name].(float64)
+		req.messageField(1, func(ts *protoBuffer) {
+			// remote_write wants the labels sorted by name
+			var keys []string
+			for k := range labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				ts.messageField(1, func(l *protoBuffer) {
+					l.stringField(1, k)
+					l.stringField(2, labels[k])
+				})
+			}
+
+			ts.messageField(2, func(sample *protoBuffer) {
+				sample.doubleField(1, value)
+				sample.int64Field(2, timestamp)
+			})
+		})
+	}
+
+	return req.buf
+}
+
+// encodeSnappy frames b as a snappy block made only of literals, which any
+// snappy decoder accepts, the payloads are too small for compression to matter
+func encodeSnappy(b []byte) []byte {
+	var out []byte
+	var n [binary.MaxVarintLen64]byte
+	out = append(out, n[:binary.PutUvarint(n[:], uint64(len(b)))]...)
+
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > 1<<16 {
+			chunk = chunk[:1<<16]
+		}
+		b = b[len(chunk):]
+
+		l := len(chunk) - 1
+		switch {
+		case l < 60:
+			out = append(out, byte(l)<<2)
+		case l < 1<<8:
+			out = append(out, 60<<2, byte(l))
+		default:
+			out = append(out, 61<<2, byte(l), byte(l>>8))
+		}
+		out = append(out, chunk...)
+	}
+
+	return out
+}
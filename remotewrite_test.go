@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// decodeSnappyLiterals undoes encodeSnappy, it only understands literals
+func decodeSnappyLiterals(t *testing.T, b []byte) []byte {
+	want, n := binary.Uvarint(b)
+	b = b[n:]
+
+	var out []byte
+	for len(b) > 0 {
+		tag := b[0]
+		if tag&3 != 0 {
+			t.Fatalf("unexpected snappy copy element %x", tag)
+		}
+
+		l, skip := int(tag>>2), 1
+		switch l {
+		case 60:
+			l, skip = int(b[1]), 2
+		case 61:
+			l, skip = int(b[1])|int(b[2])<<8, 3
+		}
+		out = append(out, b[skip:skip+l+1]...)
+		b = b[skip+l+1:]
+	}
+
+	if uint64(len(out)) != want {
+		t.Fatalf("snappy length = %d, want %d", len(out), want)
+	}
+	return out
+}
+
+func Test_encodeSnappy(t *testing.T) {
+	for _, size := range []int{0, 1, 59, 60, 61, 300, 1 << 16, 200000} {
+		in := bytes.Repeat([]byte{'x'}, size)
+		if got := decodeSnappyLiterals(t, encodeSnappy(in)); !bytes.Equal(got, in) {
+			t.Errorf("encodeSnappy() of %d bytes didn't round trip", size)
+		}
+	}
+}
+
+func Test_encodeWriteRequest(t *testing.T) {
+	res := results{
+		latency:   floatPtr(9.5),
+		timestamp: time.Unix(1525500000, 0),
+	}
+
+	want := []byte{
+		0x0a, 0x44, // timeseries
+		0x0a, 0x1d, // label
+		0x0a, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_',
+		0x12, 0x11, 's', 'p', 'e', 'e', 'd', 't', 'e', 's', 't', '_', 'l', 'a', 't', 'e', 'n', 'c', 'y',
+		0x0a, 0x11, // label
+		0x0a, 0x06, 's', 't', 'a', 't', 'u', 's',
+		0x12, 0x07, 'p', 'a', 'r', 't', 'i', 'a', 'l',
+		0x12, 0x10, // sample
+		0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x23, 0x40,
+		0x10, 0x80, 0xee, 0x8a, 0xf7, 0xb2, 0x2c,
+	}
+	if got := encodeWriteRequest(res); !bytes.Equal(got, want) {
+		t.Errorf("encodeWriteRequest() = % x, want % x", got, want)
+	}
+}
+
+func Test_remoteWriteSink_WriteResult(t *testing.T) {
+	var gotReq *http.Request
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotReq = r
+		gotBody, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s := &remoteWriteSink{url: srv.URL, bearerToken: "s3cret", httpClient: http.DefaultClient}
+	res := results{
+		server:    testServer,
+		latency:   floatPtr(9.5),
+		download:  floatPtr(100),
+		upload:    floatPtr(20),
+		timestamp: time.Unix(1525500000, 0),
+	}
+	if err := s.WriteResult(res); err != nil {
+		t.Fatalf("remoteWriteSink.WriteResult() error = %v", err)
+	}
+
+	if got := gotReq.Header.Get("Content-Encoding"); got != "snappy" {
+		t.Errorf("Content-Encoding = %v, want snappy", got)
+	}
+	if got := gotReq.Header.Get("Authorization"); got != "Bearer s3cret" {
+		t.Errorf("Authorization = %v, want Bearer s3cret", got)
+	}
+	if got := decodeSnappyLiterals(t, gotBody); !bytes.Equal(got, encodeWriteRequest(res)) {
+		t.Errorf("body doesn't decode to the write request")
+	}
+}
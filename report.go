@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/urfave/cli"
+)
+
+var reportCommand = cli.Command{
+	Name:  "report",
+	Usage: "Write a monthly plan compliance report from the recorded results",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "month",
+			Usage: "The month to report on as YYYY-MM, defaults to last month",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "markdown",
+			Usage: "The report format, markdown, html or csv (one row per test)",
+		},
+		cli.StringFlag{
+			Name:  "source",
+			Value: "sqlite",
+			Usage: "Where to read results from, sqlite (--sqlite-path) or influx (the v1 influxDB flags)",
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "Write the report to this file instead of stdout",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		err := runReport(c)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		return nil
+	},
+}
+
+func runReport(c *cli.Context) error {
+	// the report may be going to stdout
+	log.SetOutput(os.Stderr)
+
+	contract := planFromFlags(c)
+	if contract.download <= 0 && contract.upload <= 0 && contract.latency <= 0 {
+		return errors.New("set --plan-download, --plan-upload or --plan-latency to report compliance")
+	}
+
+	format := c.String("format")
+	if format != "markdown" && format != "html" && format != "csv" {
+		return fmt.Errorf("unsupported report format %q", format)
+	}
+
+	from, to, err := reportMonth(c.String("month"), time.Now())
+	if err != nil {
+		return err
+	}
+
+	all, err := loadReportResults(c, from, to)
+	if err != nil {
+		return err
+	}
+	for i := range all {
+		all[i].plan = contract
+	}
+
+	out := io.Writer(os.Stdout)
+	if c.String("output") != "" {
+		f, err := os.Create(c.String("output"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	r := buildReport(all, contract, from, to)
+	switch format {
+	case "html":
+		return writeHTMLReport(out, r)
+	case "csv":
+		return writeCSVReport(out, r)
+	default:
+		return writeMarkdownReport(out, r)
+	}
+}
+
+// reportMonth returns the local start and end of the month, or of the month
+// before now when it's empty
+func reportMonth(month string, now time.Time) (time.Time, time.Time, error) {
+	var from time.Time
+	if month == "" {
+		y, m, _ := now.Date()
+		from = time.Date(y, m-1, 1, 0, 0, 0, 0, now.Location())
+	} else {
+		var err error
+		from, err = time.ParseInLocation("2006-01", month, now.Location())
+		if err != nil {
+			return from, from, fmt.Errorf("invalid month %q, want YYYY-MM", month)
+		}
+	}
+
+	return from, from.AddDate(0, 1, 0), nil
+}
+
+func loadReportResults(c *cli.Context, from time.Time, to time.Time) ([]results, error) {
+	switch c.String("source") {
+	case "sqlite":
+		if c.GlobalString("sqlite-path") == "" {
+			return nil, errors.New("--sqlite-path is required to report from the local history")
+		}
+
+		h, err := openHistory(c.GlobalString("sqlite-path"))
+		if err != nil {
+			return nil, err
+		}
+		defer h.Close()
+
+		return h.results(from, to)
+	case "influx":
+		if c.GlobalString("influx-api") != "v1" || c.GlobalString("influx-transport") != "http" {
+			return nil, errors.New("the report can only query influxDB over the v1 HTTP API")
+		}
+
+		db, err := influxDBClient(c.GlobalString("influxURL"), c.GlobalString("influxUsername"), c.GlobalString(influxPasswordFlag))
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		return influxResults(db, c.GlobalString("influxDB"), c.GlobalString("influx-retention-policy"), from, to)
+	default:
+		return nil, fmt.Errorf("unsupported report source %q", c.String("source"))
+	}
+}
+
+// influxResults reads back the speedtest points written by writeMetrics
+func influxResults(db client.Client, database string, rp string, from time.Time, to time.Time) ([]results, error) {
+	measurement := `"speedtest"`
+	if rp != "" {
+		measurement = quoteIdent(rp) + "." + measurement
+	}
+
+	resp, err := db.Query(client.Query{
+		Command:   fmt.Sprintf("SELECT * FROM %s WHERE time >= %ds AND time < %ds", measurement, from.Unix(), to.Unix()),
+		Database:  database,
+		Precision: "s",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+
+	var all []results
+	for _, result := range resp.Results {
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				values := map[string]interface{}{}
+				for i, column := range series.Columns {
+					if i < len(row) && row[i] != nil {
+						values[column] = row[i]
+					}
+				}
+				all = append(all, influxRowResult(values))
+			}
+		}
+	}
+
+	return all, nil
+}
+
+func influxRowResult(values map[string]interface{}) results {
+	var res results
+
+	if at, ok := numberValue(values["time"]); ok {
+		res.timestamp = time.Unix(int64(at), 0)
+	}
+	for column, dst := range map[string]**float64{"latency": &res.latency, "download": &res.download, "upload": &res.upload} {
+		if v, ok := numberValue(values[column]); ok {
+			*dst = &v
+		}
+	}
+
+	res.failedPhase, _ = values["failed_phase"].(string)
+	if msg, ok := values["error"].(string); ok {
+		res.err = errors.New(msg)
+	}
+
+	res.server.ID, _ = values["server_id"].(string)
+	res.server.Name, _ = values["server_name"].(string)
+	res.server.Sponsor, _ = values["server_sponsor"].(string)
+	res.server.URL, _ = values["server_url"].(string)
+	res.server.Country, _ = values["server_country"].(string)
+	res.server.Distance, _ = numberValue(values["server_distance"])
+
+	return res
+}
+
+// numberValue reads a number from a query response, which decodes them as
+// json.Number
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	}
+
+	return 0, false
+}
+
+// complianceReport is the month's results measured against the plan
+type complianceReport struct {
+	from     time.Time
+	to       time.Time
+	plan     plan
+	results  []results
+	statuses map[string]int
+
+	download metricStats
+	upload   metricStats
+	latency  metricStats
+
+	downloadMet int
+	uploadMet   int
+	latencyMet  int
+	planMet     int
+
+	hours    [24]hourCompliance
+	failures []reportFailure
+}
+
+// hourCompliance is how the plan held up at one hour of the day
+type hourCompliance struct {
+	hour     int
+	tests    int
+	met      int
+	download metricStats
+}
+
+// reportFailure is a test that didn't meet the plan, and why
+type reportFailure struct {
+	at     time.Time
+	reason string
+}
+
+func buildReport(all []results, contract plan, from time.Time, to time.Time) *complianceReport {
+	r := &complianceReport{from: from, to: to, plan: contract, results: all, statuses: map[string]int{}}
+	for i := range r.hours {
+		r.hours[i].hour = i
+	}
+
+	for _, res := range all {
+		r.statuses[res.status()]++
+		if res.download != nil {
+			r.download.add(*res.download)
+		}
+		if res.upload != nil {
+			r.upload.add(*res.upload)
+		}
+		if res.latency != nil {
+			r.latency.add(*res.latency)
+		}
+
+		if contract.meetsDownload(res) {
+			r.downloadMet++
+		}
+		if contract.meetsUpload(res) {
+			r.uploadMet++
+		}
+		if contract.meetsLatency(res) {
+			r.latencyMet++
+		}
+
+		met := contract.meets(res)
+		hour := &r.hours[res.timestamp.Hour()]
+		hour.tests++
+		if met {
+			r.planMet++
+			hour.met++
+		}
+		if pct, ok := pctOf(res.download, contract.download); ok {
+			hour.download.add(pct)
+		}
+
+		if !met {
+			r.failures = append(r.failures, reportFailure{at: res.timestamp, reason: failureReason(res, contract)})
+		}
+	}
+
+	return r
+}
+
+// failureReason explains why a test didn't meet the plan
+func failureReason(res results, contract plan) string {
+	if res.status() != statusOK {
+		reason := fmt.Sprintf("test %s during the %s phase", res.status(), res.failedPhase)
+		if res.err != nil {
+			reason += ": " + res.err.Error()
+		}
+		return reason
+	}
+
+	var reasons []string
+	if pct, ok := pctOf(res.download, contract.download); ok && pct < contract.minPct {
+		reasons = append(reasons, fmt.Sprintf("download %.2f Mbit/s is %.0f%% of plan", *res.download, pct))
+	}
+	if pct, ok := pctOf(res.upload, contract.upload); ok && pct < contract.minPct {
+		reasons = append(reasons, fmt.Sprintf("upload %.2f Mbit/s is %.0f%% of plan", *res.upload, pct))
+	}
+	if contract.latency > 0 && *res.latency > contract.latency {
+		reasons = append(reasons, fmt.Sprintf("latency %.2f ms is over %.0f ms", *res.latency, contract.latency))
+	}
+
+	return strings.Join(reasons, ", ")
+}
+
+// worstHours returns up to n hours of the day with tests, least compliant
+// first
+func (r *complianceReport) worstHours(n int) []hourCompliance {
+	var hours []hourCompliance
+	for _, h := range r.hours {
+		if h.tests > 0 {
+			hours = append(hours, h)
+		}
+	}
+
+	sort.SliceStable(hours, func(i, j int) bool {
+		ci, cj := percent(hours[i].met, hours[i].tests), percent(hours[j].met, hours[j].tests)
+		if ci != cj {
+			return ci < cj
+		}
+		return hours[i].download.avg() < hours[j].download.avg()
+	})
+	if len(hours) > n {
+		hours = hours[:n]
+	}
+
+	return hours
+}
+
+func percent(n int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(n) / float64(total) * 100
+}
+
+// reportView is the report laid out for the markdown and HTML templates
+type reportView struct {
+	Title      string
+	Period     string
+	Plan       string
+	Tests      string
+	Compliance [][]string
+	Stats      [][]string
+	WorstHours [][]string
+	Failures   [][]string
+}
+
+func (r *complianceReport) view() reportView {
+	v := reportView{
+		Title:  "Plan compliance report, " + r.from.Format("January 2006"),
+		Period: fmt.Sprintf("%s to %s", r.from.Format("2006-01-02"), r.to.AddDate(0, 0, -1).Format("2006-01-02")),
+		Tests: fmt.Sprintf("%d tests, %d ok, %d partial, %d failed",
+			len(r.results), r.statuses[statusOK], r.statuses[statusPartial], r.statuses[statusFailed]),
+	}
+
+	var parts []string
+	row := func(name string, met int) []string {
+		return []string{name, strconv.Itoa(len(r.results)), strconv.Itoa(met), fmt.Sprintf("%.1f%%", percent(met, len(r.results)))}
+	}
+	if r.plan.download > 0 {
+		parts = append(parts, fmt.Sprintf("%g Mbit/s download", r.plan.download))
+		v.Compliance = append(v.Compliance, row("Download", r.downloadMet))
+	}
+	if r.plan.upload > 0 {
+		parts = append(parts, fmt.Sprintf("%g Mbit/s upload", r.plan.upload))
+		v.Compliance = append(v.Compliance, row("Upload", r.uploadMet))
+	}
+	if r.plan.latency > 0 {
+		parts = append(parts, fmt.Sprintf("at most %g ms latency", r.plan.latency))
+		v.Compliance = append(v.Compliance, row("Latency", r.latencyMet))
+	}
+	v.Compliance = append(v.Compliance, row("Whole plan", r.planMet))
+	v.Plan = fmt.Sprintf("%s, speeds are met at %g%% of the advertised rate", strings.Join(parts, ", "), r.plan.minPct)
+
+	for _, m := range []struct {
+		name  string
+		unit  string
+		stats metricStats
+	}{
+		{"Download", "Mbit/s", r.download},
+		{"Upload", "Mbit/s", r.upload},
+		{"Latency", "ms", r.latency},
+	} {
+		if m.stats.count == 0 {
+			continue
+		}
+		v.Stats = append(v.Stats, []string{m.name + " (" + m.unit + ")",
+			fmt.Sprintf("%.2f", m.stats.min), fmt.Sprintf("%.2f", m.stats.avg()), fmt.Sprintf("%.2f", m.stats.max)})
+	}
+
+	for _, h := range r.worstHours(5) {
+		avg := "n/a"
+		if h.download.count > 0 {
+			avg = fmt.Sprintf("%.1f%%", h.download.avg())
+		}
+		v.WorstHours = append(v.WorstHours, []string{fmt.Sprintf("%02d:00-%02d:00", h.hour, (h.hour+1)%24),
+			strconv.Itoa(h.tests), fmt.Sprintf("%.1f%%", percent(h.met, h.tests)), avg})
+	}
+
+	for _, f := range r.failures {
+		v.Failures = append(v.Failures, []string{f.at.Format("2006-01-02 15:04"), f.reason})
+	}
+
+	return v
+}
+
+var markdownReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"row": func(cells []string) string {
+		escape := strings.NewReplacer("|", `\|`, "\n", " ")
+		escaped := make([]string, len(cells))
+		for i, cell := range cells {
+			escaped[i] = escape.Replace(cell)
+		}
+		return "| " + strings.Join(escaped, " | ") + " |"
+	},
+}).Parse(`# {{.Title}}
+
+Period: {{.Period}}  
+Plan: {{.Plan}}  
+Tests: {{.Tests}}
+
+## Compliance
+
+| Measure | Tests | Met | Compliance |
+| --- | ---: | ---: | ---: |
+{{range .Compliance}}{{row .}}
+{{end}}
+## Measurements
+
+| Metric | Min | Avg | Max |
+| --- | ---: | ---: | ---: |
+{{range .Stats}}{{row .}}
+{{end}}
+## Worst hours
+
+| Hour | Tests | Compliance | Avg download of plan |
+| --- | ---: | ---: | ---: |
+{{range .WorstHours}}{{row .}}
+{{end}}
+## Tests not meeting the plan
+
+{{if .Failures}}| Time | Reason |
+| --- | --- |
+{{range .Failures}}{{row .}}
+{{end}}{{else}}None.
+{{end}}`))
+
+func writeMarkdownReport(w io.Writer, r *complianceReport) error {
+	return markdownReport.Execute(w, r.view())
+}
+
+var htmlReport = htmltemplate.Must(htmltemplate.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Period: {{.Period}}<br>Plan: {{.Plan}}<br>Tests: {{.Tests}}</p>
+<h2>Compliance</h2>
+<table>
+<tr><th>Measure</th><th>Tests</th><th>Met</th><th>Compliance</th></tr>
+{{range .Compliance}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+<h2>Measurements</h2>
+<table>
+<tr><th>Metric</th><th>Min</th><th>Avg</th><th>Max</th></tr>
+{{range .Stats}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+<h2>Worst hours</h2>
+<table>
+<tr><th>Hour</th><th>Tests</th><th>Compliance</th><th>Avg download of plan</th></tr>
+{{range .WorstHours}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+<h2>Tests not meeting the plan</h2>
+{{if .Failures}}<table>
+<tr><th>Time</th><th>Reason</th></tr>
+{{range .Failures}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+</body>
+</html>
+`))
+
+func writeHTMLReport(w io.Writer, r *complianceReport) error {
+	return htmlReport.Execute(w, r.view())
+}
+
+// writeCSVReport writes a row per test, the evidence behind the summary
+func writeCSVReport(w io.Writer, r *complianceReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"timestamp", "status", "latency", "download", "upload", "download_pct_of_plan", "upload_pct_of_plan",
+		"meets_download", "meets_upload", "meets_latency", "meets_plan", "failed_phase", "error",
+	})
+
+	value := func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*f, 'f', -1, 64)
+	}
+	meets := func(set bool, met bool) string {
+		if !set {
+			return ""
+		}
+		return strconv.FormatBool(met)
+	}
+
+	for _, res := range r.results {
+		var downloadPct, uploadPct string
+		if pct, ok := pctOf(res.download, r.plan.download); ok {
+			downloadPct = strconv.FormatFloat(pct, 'f', 1, 64)
+		}
+		if pct, ok := pctOf(res.upload, r.plan.upload); ok {
+			uploadPct = strconv.FormatFloat(pct, 'f', 1, 64)
+		}
+		var errText string
+		if res.err != nil {
+			errText = res.err.Error()
+		}
+
+		cw.Write([]string{
+			res.timestamp.Format(time.RFC3339), res.status(), value(res.latency), value(res.download), value(res.upload),
+			downloadPct, uploadPct,
+			meets(r.plan.download > 0, r.plan.meetsDownload(res)),
+			meets(r.plan.upload > 0, r.plan.meetsUpload(res)),
+			meets(r.plan.latency > 0, r.plan.meetsLatency(res)),
+			strconv.FormatBool(r.plan.meets(res)),
+			res.failedPhase, errText,
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+func Test_reportMonth(t *testing.T) {
+	now := time.Date(2018, 1, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		month    string
+		wantFrom time.Time
+		wantErr  bool
+	}{
+		{"last month across a year", "", time.Date(2017, 12, 1, 0, 0, 0, 0, time.UTC), false},
+		{"given month", "2017-06", time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), false},
+		{"invalid", "June", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := reportMonth(tt.month, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reportMonth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (!from.Equal(tt.wantFrom) || !to.Equal(tt.wantFrom.AddDate(0, 1, 0))) {
+				t.Errorf("reportMonth() = %s to %s, want a month from %s", from, to, tt.wantFrom)
+			}
+		})
+	}
+}
+
+func testReport() *complianceReport {
+	contract := plan{download: 100, upload: 10, latency: 30, minPct: 80}
+	at := func(day, hour int) time.Time { return time.Date(2017, 6, day, hour, 0, 0, 0, time.UTC) }
+
+	all := []results{
+		{latency: floatPtr(10), download: floatPtr(95), upload: floatPtr(10), timestamp: at(1, 3)},
+		{latency: floatPtr(12), download: floatPtr(90), upload: floatPtr(9), timestamp: at(2, 3)},
+		{latency: floatPtr(40), download: floatPtr(50), upload: floatPtr(9), timestamp: at(1, 20)},
+		{latency: floatPtr(15), download: floatPtr(85), upload: floatPtr(9.5), timestamp: at(2, 20)},
+		{failedPhase: phaseConfig, err: errors.New("no route | to host"), timestamp: at(3, 20)},
+	}
+	for i := range all {
+		all[i].plan = contract
+	}
+
+	return buildReport(all, contract, at(1, 0), time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func Test_buildReport(t *testing.T) {
+	r := testReport()
+
+	if r.downloadMet != 3 || r.uploadMet != 4 || r.latencyMet != 3 || r.planMet != 3 {
+		t.Errorf("buildReport() met download %d, upload %d, latency %d, plan %d, want 3, 4, 3, 3",
+			r.downloadMet, r.uploadMet, r.latencyMet, r.planMet)
+	}
+
+	worst := r.worstHours(5)
+	if len(worst) != 2 || worst[0].hour != 20 || worst[0].tests != 3 || worst[0].met != 1 {
+		t.Errorf("worstHours() = %+v, want 20:00 first with 1 of 3 met", worst)
+	}
+
+	wantReasons := []string{
+		"download 50.00 Mbit/s is 50% of plan, latency 40.00 ms is over 30 ms",
+		"test failed during the config phase: no route | to host",
+	}
+	if len(r.failures) != len(wantReasons) {
+		t.Fatalf("buildReport() failures = %+v, want %d", r.failures, len(wantReasons))
+	}
+	for i, want := range wantReasons {
+		if r.failures[i].reason != want {
+			t.Errorf("failure %d reason = %q, want %q", i, r.failures[i].reason, want)
+		}
+	}
+}
+
+func Test_writeReport(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(*bytes.Buffer, *complianceReport) error
+		want  []string
+	}{
+		{
+			name:  "markdown",
+			write: func(b *bytes.Buffer, r *complianceReport) error { return writeMarkdownReport(b, r) },
+			want: []string{
+				"# Plan compliance report, June 2017\n",
+				"Plan: 100 Mbit/s download, 10 Mbit/s upload, at most 30 ms latency, speeds are met at 80% of the advertised rate",
+				"| Whole plan | 5 | 3 | 60.0% |\n",
+				"| 20:00-21:00 | 3 | 33.3% | 67.5% |\n",
+				"| 2017-06-03 20:00 | test failed during the config phase: no route \\| to host |\n",
+			},
+		},
+		{
+			name:  "html",
+			write: func(b *bytes.Buffer, r *complianceReport) error { return writeHTMLReport(b, r) },
+			want: []string{
+				"<title>Plan compliance report, June 2017</title>",
+				"<tr><td>Whole plan</td><td>5</td><td>3</td><td>60.0%</td></tr>",
+			},
+		},
+		{
+			name:  "csv",
+			write: func(b *bytes.Buffer, r *complianceReport) error { return writeCSVReport(b, r) },
+			want: []string{
+				"timestamp,status,latency,download,upload,download_pct_of_plan,upload_pct_of_plan,meets_download,meets_upload,meets_latency,meets_plan,failed_phase,error\n",
+				"2017-06-01T20:00:00Z,ok,40,50,9,50.0,90.0,false,true,false,false,,\n",
+				"2017-06-03T20:00:00Z,failed,,,,,,false,false,false,false,config,no route | to host\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tt.write(&b, testReport()); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(b.String(), want) {
+					t.Errorf("report is missing %q:\n%s", want, b.String())
+				}
+			}
+		})
+	}
+}
+
+func Test_influxResults(t *testing.T) {
+	from, to := time.Unix(1500000000, 0), time.Unix(1500086400, 0)
+	query := `SELECT * FROM "month"."speedtest" WHERE time >= 1500000000s AND time < 1500086400s`
+
+	db := &fakeInfluxClient{responses: map[string]*client.Response{
+		query: {Results: []client.Result{{Series: []models.Row{{
+			Name:    "speedtest",
+			Columns: []string{"time", "download", "error", "failed_phase", "latency", "server_id", "server_sponsor", "status", "upload"},
+			Values: [][]interface{}{
+				{json.Number("1500000100"), json.Number("94.2"), nil, nil, json.Number("9.5"), "1234", "Example ISP", "ok", json.Number("11.7")},
+				{json.Number("1500001300"), nil, "no route to host", "config", nil, nil, nil, "failed", nil},
+			},
+		}}}}},
+	}}
+
+	all, err := influxResults(db, "speedtest", "month", from, to)
+	if err != nil {
+		t.Fatalf("influxResults() error = %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("influxResults() returned %d results, want 2", len(all))
+	}
+
+	if got := all[0]; got.status() != statusOK || *got.download != 94.2 || got.server.Sponsor != "Example ISP" || got.timestamp.Unix() != 1500000100 {
+		t.Errorf("influxResults()[0] = %v at %s, want the ok result", got, got.timestamp)
+	}
+	if got := all[1]; got.status() != statusFailed || got.failedPhase != phaseConfig || got.err == nil {
+		t.Errorf("influxResults()[1] = %v, want the failed result", got)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// influxHTTPError is an error response from the influxDB HTTP API that kept
+// its status code, so it can be told apart from a transport failure
+type influxHTTPError struct {
+	statusCode int
+	message    string
+}
+
+func (e *influxHTTPError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.statusCode, http.StatusText(e.statusCode), e.message)
+}
+
+// nonRetryableMessages are the v1 API errors that will fail the same way
+// however often they're retried, the v1 client drops the status code so the
+// body is all there is to go on
+var nonRetryableMessages = []string{
+	"authorization failed",
+	"unable to parse",
+	"partial write",
+	"field type conflict",
+	"database not found",
+	"retention policy not found",
+}
+
+// retryable reports whether a failed write is worth trying again, malformed
+// points and auth failures aren't
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *influxHTTPError:
+		return retryableStatus(e.statusCode)
+	case net.Error:
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, m := range nonRetryableMessages {
+		if strings.Contains(msg, m) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// retryableStatus reports whether an HTTP response status is worth retrying
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+}
+
+// retryStats counts retries since startup
+type retryStats struct {
+	retries int
+	gaveUp  int
+}
+
+// retryingClient wraps a client, retrying failed writes with exponential
+// backoff and jitter until they succeed, fail in a way retrying can't fix, or
+// run out of attempts or time
+type retryingClient struct {
+	client.Client
+	maxAttempts int
+	initial     time.Duration
+	maxElapsed  time.Duration
+	sleep       func(time.Duration)
+	now         func() time.Time
+
+	mu    sync.Mutex
+	stats retryStats
+}
+
+func newRetryingClient(c client.Client, maxAttempts int, initial time.Duration, maxElapsed time.Duration) *retryingClient {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	return &retryingClient{
+		Client:      c,
+		maxAttempts: maxAttempts,
+		initial:     initial,
+		maxElapsed:  maxElapsed,
+		sleep:       time.Sleep,
+		now:         time.Now,
+	}
+}
+
+func (r *retryingClient) Write(bp client.BatchPoints) error {
+	start := r.now()
+
+	for attempt := 1; ; attempt++ {
+		err := r.Client.Write(bp)
+		if err == nil || !retryable(err) {
+			return err
+		}
+
+		delay := backoff(r.initial, attempt)
+		if attempt >= r.maxAttempts || (r.maxElapsed > 0 && r.now().Sub(start)+delay > r.maxElapsed) {
+			r.mu.Lock()
+			r.stats.gaveUp++
+			r.mu.Unlock()
+
+			return fmt.Errorf("giving up after %d attempts: %v", attempt, err)
+		}
+
+		log.Printf("error writing to influxdb, retry %d of %d in %s: %v", attempt, r.maxAttempts-1, delay, err)
+		r.mu.Lock()
+		r.stats.retries++
+		r.mu.Unlock()
+
+		r.sleep(delay)
+	}
+}
+
+// maxBackoff caps the delay between retries, however many are configured
+const maxBackoff = 10 * time.Minute
+
+// backoff doubles the delay each attempt up to maxBackoff, with half of it
+// randomised so several daemons don't retry in lockstep
+func backoff(initial time.Duration, attempt int) time.Duration {
+	if initial <= 0 {
+		return 0
+	}
+
+	d := initial
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Stats returns the retry counters
+func (r *retryingClient) Stats() retryStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stats
+}
+
+func (stats retryStats) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"retries": stats.retries,
+		"gave_up": stats.gaveUp,
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_retryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &influxHTTPError{statusCode: http.StatusServiceUnavailable}, true},
+		{"rate limited", &influxHTTPError{statusCode: http.StatusTooManyRequests}, true},
+		{"unauthorized", &influxHTTPError{statusCode: http.StatusUnauthorized}, false},
+		{"bad request", &influxHTTPError{statusCode: http.StatusBadRequest}, false},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"v1 auth failure", errors.New(`{"error":"authorization failed"}`), false},
+		{"v1 malformed point", errors.New(`{"error":"unable to parse 'speedtest download=': missing field value"}`), false},
+		{"v1 timeout", errors.New(`{"error":"timeout"}`), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.err); got != tt.want {
+				t.Errorf("retryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_retryingClient_Write(t *testing.T) {
+	tests := []struct {
+		name        string
+		writeErr    error
+		maxAttempts int
+		maxElapsed  time.Duration
+		wantWrites  int
+		wantStats   retryStats
+		wantErr     bool
+	}{
+		{
+			name:        "succeeds first time",
+			maxAttempts: 4,
+			wantWrites:  1,
+		},
+		{
+			name:        "retries until out of attempts",
+			writeErr:    &influxHTTPError{statusCode: http.StatusBadGateway},
+			maxAttempts: 4,
+			wantWrites:  4,
+			wantStats:   retryStats{retries: 3, gaveUp: 1},
+			wantErr:     true,
+		},
+		{
+			name:        "retries until out of time",
+			writeErr:    &influxHTTPError{statusCode: http.StatusBadGateway},
+			maxAttempts: 10,
+			maxElapsed:  1400 * time.Millisecond,
+			wantWrites:  2,
+			wantStats:   retryStats{retries: 1, gaveUp: 1},
+			wantErr:     true,
+		},
+		{
+			name:        "doesn't retry auth failures",
+			writeErr:    &influxHTTPError{statusCode: http.StatusUnauthorized},
+			maxAttempts: 4,
+			wantWrites:  1,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeInfluxClient{writeErr: tt.writeErr}
+			r := newRetryingClient(fake, tt.maxAttempts, time.Second, tt.maxElapsed)
+
+			// a fake clock that only moves when sleeping, with the jitter
+			// range of each delay being [d/2, d]
+			clock := time.Unix(1525500000, 0)
+			r.now = func() time.Time { return clock }
+			r.sleep = func(d time.Duration) { clock = clock.Add(d) }
+
+			err := r.Write(testBatch(t, 100, clock))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("retryingClient.Write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(fake.writes) != tt.wantWrites {
+				t.Errorf("got %d writes, want %d", len(fake.writes), tt.wantWrites)
+			}
+			if got := r.Stats(); got != tt.wantStats {
+				t.Errorf("retryingClient.Stats() = %+v, want %+v", got, tt.wantStats)
+			}
+		})
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial time.Duration
+		attempt int
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{"first attempt", time.Second, 1, 500 * time.Millisecond, time.Second},
+		{"doubles", time.Second, 3, 2 * time.Second, 4 * time.Second},
+		{"capped", time.Second, 20, maxBackoff / 2, maxBackoff},
+		{"shift would overflow", time.Second, 200, maxBackoff / 2, maxBackoff},
+		{"no initial delay", 0, 5, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backoff(tt.initial, tt.attempt); got < tt.wantMin || got > tt.wantMax {
+				t.Errorf("backoff() = %v, want between %v and %v", got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var ruleFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name: "alert-rule",
+		Usage: "An alert rule such as \"slow: download < 80 for 3 clear 85 notify slack,email\" or " +
+			"\"laggy: latency > 50 in 2/5\", may be repeated",
+	},
+}
+
+// alert states, written as the state tag of speedtest_alert events
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// rule is a threshold on one numeric result field, breached when enough of
+// the recent results cross it
+type rule struct {
+	name      string
+	metric    string
+	op        string
+	threshold float64
+	clear     float64
+	breaches  int
+	window    int
+	notify    []string
+}
+
+// ruleMetrics are the numeric result fields a rule can watch
+var ruleMetrics = []string{"latency", "download", "upload", "server_distance", "download_pct_of_plan", "upload_pct_of_plan", "anomaly_score"}
+
+func isRuleMetric(name string) bool {
+	for _, m := range ruleMetrics {
+		if m == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRule reads "[name:] <field> <op> <value> [for <n> | in <m>/<n>]
+// [clear <value>] [notify <channel>,...]"
+func parseRule(text string) (rule, error) {
+	r := rule{breaches: 1, window: 1}
+
+	def := text
+	if i := strings.Index(def, ":"); i >= 0 {
+		r.name, def = strings.TrimSpace(def[:i]), def[i+1:]
+	}
+
+	tokens := strings.Fields(def)
+	if len(tokens) < 3 {
+		return r, fmt.Errorf("invalid alert rule %q, want <field> <op> <value>", text)
+	}
+
+	r.metric, r.op = tokens[0], tokens[1]
+	if !isRuleMetric(r.metric) {
+		return r, fmt.Errorf("invalid alert rule %q, unknown field %q, want one of %s", text, r.metric, strings.Join(ruleMetrics, ", "))
+	}
+
+	switch r.op {
+	case "<", "<=", ">", ">=":
+	default:
+		return r, fmt.Errorf("invalid alert rule %q, unsupported operator %q", text, r.op)
+	}
+
+	var err error
+	r.threshold, err = strconv.ParseFloat(tokens[2], 64)
+	if err != nil {
+		return r, fmt.Errorf("invalid alert rule %q, bad threshold: %v", text, err)
+	}
+	r.clear = r.threshold
+
+	rest := tokens[3:]
+	for len(rest) > 0 {
+		if len(rest) < 2 {
+			return r, fmt.Errorf("invalid alert rule %q, %q needs a value", text, rest[0])
+		}
+
+		keyword, value := rest[0], rest[1]
+		rest = rest[2:]
+
+		switch keyword {
+		case "for":
+			r.window, err = strconv.Atoi(value)
+			r.breaches = r.window
+		case "in":
+			parts := strings.SplitN(value, "/", 2)
+			if len(parts) != 2 {
+				return r, fmt.Errorf("invalid alert rule %q, want in <m>/<n>", text)
+			}
+			r.breaches, err = strconv.Atoi(parts[0])
+			if err == nil {
+				r.window, err = strconv.Atoi(parts[1])
+			}
+		case "clear":
+			r.clear, err = strconv.ParseFloat(value, 64)
+		case "notify":
+			r.notify = strings.Split(value, ",")
+		default:
+			return r, fmt.Errorf("invalid alert rule %q, unknown clause %q", text, keyword)
+		}
+		if err != nil {
+			return r, fmt.Errorf("invalid alert rule %q, bad %s: %v", text, keyword, err)
+		}
+	}
+
+	if r.window < 1 || r.breaches < 1 || r.breaches > r.window {
+		return r, fmt.Errorf("invalid alert rule %q, the window must hold at least one breach", text)
+	}
+
+	// the clear threshold has to be on the good side of the threshold, or
+	// the alert could resolve while still breaching
+	if (r.below() && r.clear < r.threshold) || (!r.below() && r.clear > r.threshold) {
+		return r, fmt.Errorf("invalid alert rule %q, clear %g is on the wrong side of %g", text, r.clear, r.threshold)
+	}
+
+	if r.name == "" {
+		direction := "above"
+		if r.below() {
+			direction = "below"
+		}
+		r.name = fmt.Sprintf("%s_%s_%g", r.metric, direction, r.threshold)
+	}
+
+	return r, nil
+}
+
+func parseRules(texts []string) ([]rule, error) {
+	var rules []rule
+	names := map[string]bool{}
+	for _, text := range texts {
+		r, err := parseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		if names[r.name] {
+			return nil, fmt.Errorf("duplicate alert rule name %q", r.name)
+		}
+		names[r.name] = true
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// condition describes the rule without its name and routing
+func (r rule) condition() string {
+	c := fmt.Sprintf("%s %s %g", r.metric, r.op, r.threshold)
+	switch {
+	case r.breaches != r.window:
+		c += fmt.Sprintf(" in %d/%d", r.breaches, r.window)
+	case r.window > 1:
+		c += fmt.Sprintf(" for %d", r.window)
+	}
+	if r.clear != r.threshold {
+		c += fmt.Sprintf(" clear %g", r.clear)
+	}
+
+	return c
+}
+
+func (r rule) below() bool {
+	return r.op == "<" || r.op == "<="
+}
+
+// crosses reports whether v breaches the given threshold
+func (r rule) crosses(v float64, threshold float64) bool {
+	switch r.op {
+	case "<":
+		return v < threshold
+	case "<=":
+		return v <= threshold
+	case ">":
+		return v > threshold
+	default:
+		return v >= threshold
+	}
+}
+
+// ruleState is the recent values of a rule's field and whether it's firing
+type ruleState struct {
+	rule   rule
+	values []float64
+	firing bool
+}
+
+// ruleEngine evaluates every rule against each result
+type ruleEngine struct {
+	states []*ruleState
+}
+
+func newRuleEngine(rules []rule) *ruleEngine {
+	e := &ruleEngine{}
+	for _, r := range rules {
+		e.states = append(e.states, &ruleState{rule: r})
+	}
+
+	return e
+}
+
+// evaluate returns an event for every rule that started firing or resolved.
+// Results missing a rule's field don't count towards it.
+func (e *ruleEngine) evaluate(res results) []event {
+	fields := resultFields(res)
+
+	var events []event
+	for _, st := range e.states {
+		v, ok := fields[st.rule.metric].(float64)
+		if !ok {
+			continue
+		}
+
+		st.values = append(st.values, v)
+		if len(st.values) > st.rule.window {
+			st.values = st.values[1:]
+		}
+
+		// once firing, values are held to the clear threshold instead
+		threshold := st.rule.threshold
+		if st.firing {
+			threshold = st.rule.clear
+		}
+
+		var breaches int
+		for _, recent := range st.values {
+			if st.rule.crosses(recent, threshold) {
+				breaches++
+			}
+		}
+
+		breached := breaches >= st.rule.breaches
+		if breached == st.firing {
+			continue
+		}
+		st.firing = breached
+
+		ev := st.event(v, res.timestamp)
+		log.Printf("alert %s is %s, %s is %g", st.rule.name, ev.tags["state"], st.rule.metric, v)
+		events = append(events, ev)
+	}
+
+	return events
+}
+
+func (st *ruleState) event(v float64, at time.Time) event {
+	state := alertResolved
+	if st.firing {
+		state = alertFiring
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	return event{
+		name: "speedtest_alert",
+		tags: map[string]string{
+			"rule":   st.rule.name,
+			"state":  state,
+			"metric": st.rule.metric,
+		},
+		fields: map[string]interface{}{
+			"value":     v,
+			"threshold": st.rule.threshold,
+			"condition": st.rule.condition(),
+		},
+		at: at,
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    rule
+		wantErr bool
+	}{
+		{
+			name: "consecutive with hysteresis and routing",
+			text: "slow: download < 80 for 3 clear 85 notify slack,email",
+			want: rule{name: "slow", metric: "download", op: "<", threshold: 80, clear: 85, breaches: 3, window: 3, notify: []string{"slack", "email"}},
+		},
+		{
+			name: "m of n with a generated name",
+			text: "latency > 50 in 2/5",
+			want: rule{name: "latency_above_50", metric: "latency", op: ">", threshold: 50, clear: 50, breaches: 2, window: 5},
+		},
+		{
+			name: "plan percentage",
+			text: "download_pct_of_plan < 80",
+			want: rule{name: "download_pct_of_plan_below_80", metric: "download_pct_of_plan", op: "<", threshold: 80, clear: 80, breaches: 1, window: 1},
+		},
+		{"misspelled field", "downlaod < 80 for 3", rule{}, true},
+		{"non-numeric field", "error > 0", rule{}, true},
+		{"unknown operator", "download != 80", rule{}, true},
+		{"clear on the wrong side", "download < 80 clear 70", rule{}, true},
+		{"more breaches than the window", "latency > 50 in 6/5", rule{}, true},
+		{"clause without a value", "latency > 50 for", rule{}, true},
+		{"unknown clause", "latency > 50 during 5", rule{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRule(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ruleEngine_evaluate(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   string
+		values []float64
+		want   []string
+	}{
+		{
+			name:   "consecutive",
+			rule:   "slow: download < 80 for 3",
+			values: []float64{70, 70, 90, 70, 70, 70, 75, 81},
+			want:   []string{"", "", "", "", "", alertFiring, "", alertResolved},
+		},
+		{
+			name:   "hysteresis holds until the clear threshold",
+			rule:   "slow: download < 80 clear 85",
+			values: []float64{70, 82, 84, 86, 82},
+			want:   []string{alertFiring, "", "", alertResolved, ""},
+		},
+		{
+			name:   "m of n",
+			rule:   "laggy: latency > 50 in 2/4",
+			values: []float64{60, 10, 10, 60, 10, 10, 60},
+			want:   []string{"", "", "", alertFiring, alertResolved, "", alertFiring},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseRules([]string{tt.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := newRuleEngine(rules)
+
+			for i, v := range tt.values {
+				v := v
+				res := results{latency: &v, download: &v}
+
+				var got string
+				if events := e.evaluate(res); len(events) > 0 {
+					got = events[0].tags["state"]
+				}
+				if got != tt.want[i] {
+					t.Errorf("evaluate() of value %d (%g) = %q, want %q", i, v, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_ruleEngine_missingField(t *testing.T) {
+	rules, err := parseRules([]string{"download < 80 for 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newRuleEngine(rules)
+
+	for _, res := range []results{{download: floatPtr(50)}, {failedPhase: phaseConfig}, {download: floatPtr(50)}} {
+		if events := e.evaluate(res); len(events) > 0 && res.download == nil {
+			t.Errorf("evaluate() of a result without the field = %v", events)
+		}
+	}
+	if !e.states[0].firing {
+		t.Errorf("rule isn't firing after two breaches around a failed result")
+	}
+}
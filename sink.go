@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// sink is an output every speedtest result is fanned out to
+type sink interface {
+	Name() string
+	WriteResult(res results) error
+	Close() error
+}
+
+// eventSink is implemented by sinks that also record events, such as outages
+// starting and ending
+type eventSink interface {
+	WriteEvent(ev event) error
+}
+
+// event is something that happened outside of a result, written to influxDB
+// as its own measurement
+type event struct {
+	name   string
+	tags   map[string]string
+	fields map[string]interface{}
+	at     time.Time
+}
+
+// sinkFactories build the configured sinks, returning a nil sink when one
+// isn't enabled. A sink that sets its backend up (influxDB, postgres, the
+// elasticsearch template) fails startup when it can't, rather than running
+// with nowhere to write; only influxDB's spool can hold results until then.
+// The rest don't contact their backend until the first write.
+var sinkFactories = []func(c *cli.Context) (sink, error){
+	newInfluxSink,
+	newPrometheusSink,
+	newRemoteWriteSink,
+	newGraphiteSink,
+	newStatsdSink,
+	newMQTTSink,
+	newOTLPSink,
+	newHistorySink,
+	newFileSink,
+	newWebhookSink,
+	newPostgresSink,
+	newElasticsearchSink,
+	newLokiSink,
+	newNotifySink,
+}
+
+// sinkQueueSize is how many writes can back up behind a slow sink before
+// further writes to it are dropped
+const sinkQueueSize = 16
+
+// sinkHealth is the state of a sink as of its last write
+type sinkHealth struct {
+	name        string
+	healthy     bool
+	lastError   string
+	lastSuccess time.Time
+	failures    int
+	dropped     int
+}
+
+// sinkWrite is one queued write, results also report the sink's health
+// once they're written
+type sinkWrite struct {
+	write  func() error
+	result bool
+	at     time.Time
+}
+
+// sinkWorker writes to one sink from its own goroutine so that a slow or
+// failing sink can't hold up the others
+type sinkWorker struct {
+	sink   sink
+	queue  chan sinkWrite
+	fanout *fanout
+
+	mu     sync.Mutex
+	health sinkHealth
+}
+
+type fanout struct {
+	workers []*sinkWorker
+	wg      sync.WaitGroup
+
+	// closed stops the workers queueing health events once close has
+	// started closing their queues
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newSinks builds every enabled sink and starts fanning out to them
+func newSinks(c *cli.Context) (*fanout, error) {
+	var sinks []sink
+	for _, factory := range sinkFactories {
+		s, err := factory(c)
+		if err != nil {
+			for _, opened := range sinks {
+				opened.Close()
+			}
+			return nil, err
+		}
+		if s != nil {
+			sinks = append(sinks, s)
+		}
+	}
+
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no output sinks are enabled")
+	}
+
+	return newFanout(sinks...), nil
+}
+
+func newFanout(sinks ...sink) *fanout {
+	f := &fanout{}
+	for _, s := range sinks {
+		w := &sinkWorker{
+			sink:   s,
+			queue:  make(chan sinkWrite, sinkQueueSize),
+			fanout: f,
+			health: sinkHealth{name: s.Name(), healthy: true},
+		}
+		f.workers = append(f.workers, w)
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			w.run()
+		}()
+	}
+
+	return f
+}
+
+// writeResult queues the result for every sink, each then writes its health
+// as an event once the result is written
+func (f *fanout) writeResult(res results) {
+	for _, w := range f.workers {
+		s := w.sink
+		w.enqueue(sinkWrite{write: func() error { return s.WriteResult(res) }, result: true, at: res.timestamp})
+	}
+}
+
+// writeEvent queues the event for every sink that records events
+func (f *fanout) writeEvent(ev event) {
+	for _, w := range f.workers {
+		s, ok := w.sink.(eventSink)
+		if !ok {
+			continue
+		}
+		w.enqueue(sinkWrite{write: func() error { return s.WriteEvent(ev) }})
+	}
+}
+
+// health returns the state of every sink
+func (f *fanout) health() []sinkHealth {
+	var health []sinkHealth
+	for _, w := range f.workers {
+		w.mu.Lock()
+		health = append(health, w.health)
+		w.mu.Unlock()
+	}
+
+	return health
+}
+
+// event converts the sink health for writing to the sinks
+func (h sinkHealth) event(at time.Time) event {
+	fields := map[string]interface{}{
+		"healthy":    h.healthy,
+		"failures":   h.failures,
+		"dropped":    h.dropped,
+		"last_error": h.lastError,
+	}
+	if !h.lastSuccess.IsZero() {
+		fields["last_success"] = h.lastSuccess.Unix()
+	}
+
+	return event{
+		name:   "speedtest_sink_health",
+		tags:   map[string]string{"sink": h.name},
+		fields: fields,
+		at:     at,
+	}
+}
+
+// close waits for queued writes to finish and closes every sink
+func (f *fanout) close() {
+	f.mu.Lock()
+	f.closed = true
+	for _, w := range f.workers {
+		close(w.queue)
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+
+	for _, w := range f.workers {
+		err := w.sink.Close()
+		if err != nil {
+			log.Printf("error closing %s sink: %v", w.sink.Name(), err)
+		}
+	}
+}
+
+func (w *sinkWorker) enqueue(write sinkWrite) {
+	w.fanout.mu.RLock()
+	defer w.fanout.mu.RUnlock()
+	if w.fanout.closed {
+		return
+	}
+
+	select {
+	case w.queue <- write:
+	default:
+		w.mu.Lock()
+		w.health.dropped++
+		w.mu.Unlock()
+		log.Printf("%s sink is falling behind, dropping a write", w.sink.Name())
+	}
+}
+
+func (w *sinkWorker) run() {
+	for write := range w.queue {
+		err := write.write()
+
+		w.mu.Lock()
+		wasHealthy := w.health.healthy
+		if err != nil {
+			w.health.healthy = false
+			w.health.lastError = err.Error()
+			w.health.failures++
+		} else {
+			w.health.healthy = true
+			w.health.lastError = ""
+			w.health.lastSuccess = time.Now()
+		}
+		health := w.health
+		w.mu.Unlock()
+
+		switch {
+		case err != nil:
+			log.Printf("error writing to %s sink: %v", w.sink.Name(), err)
+		case !wasHealthy:
+			log.Printf("%s sink recovered", w.sink.Name())
+		}
+
+		// a failing sink shows up in the ones that are still working
+		if write.result {
+			w.fanout.writeEvent(health.event(write.at))
+		}
+	}
+}
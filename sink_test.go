@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink records the results and events written to it
+type fakeSink struct {
+	name     string
+	err      error
+	block    chan struct{}
+	mu       sync.Mutex
+	results  []results
+	events   []event
+	closed   bool
+	received chan struct{}
+}
+
+func newFakeSink(name string, err error) *fakeSink {
+	return &fakeSink{name: name, err: err, received: make(chan struct{}, 64)}
+}
+
+func (f *fakeSink) Name() string {
+	return f.name
+}
+
+func (f *fakeSink) WriteResult(res results) error {
+	if f.block != nil {
+		<-f.block
+	}
+
+	f.mu.Lock()
+	f.results = append(f.results, res)
+	f.mu.Unlock()
+	f.received <- struct{}{}
+
+	return f.err
+}
+
+func (f *fakeSink) WriteEvent(ev event) error {
+	f.mu.Lock()
+	f.events = append(f.events, ev)
+	f.mu.Unlock()
+	f.received <- struct{}{}
+
+	return f.err
+}
+
+func (f *fakeSink) Close() error {
+	f.closed = true
+	return nil
+}
+
+func waitReceived(t *testing.T, f *fakeSink) {
+	select {
+	case <-f.received:
+	case <-time.After(time.Second):
+		t.Fatalf("%s sink never received a write", f.name)
+	}
+}
+
+func Test_fanout_writeResult(t *testing.T) {
+	failing := newFakeSink("failing", errors.New("connection refused"))
+	stuck := newFakeSink("stuck", nil)
+	stuck.block = make(chan struct{})
+	healthy := newFakeSink("healthy", nil)
+
+	f := newFanout(failing, stuck, healthy)
+
+	res := results{latency: floatPtr(9.5)}
+	f.writeResult(res)
+	f.writeEvent(outageEvent{kind: outageStart}.event())
+
+	// the stuck sink mustn't hold up the others
+	waitReceived(t, failing)
+	waitReceived(t, failing)
+	waitReceived(t, healthy)
+	waitReceived(t, healthy)
+
+	close(stuck.block)
+	waitReceived(t, stuck)
+	waitReceived(t, stuck)
+	f.close()
+
+	for _, s := range []*fakeSink{failing, stuck, healthy} {
+		if len(s.results) != 1 || len(outageEvents(s)) != 1 {
+			t.Errorf("%s sink got %d results and %d outage events, want 1 of each", s.name, len(s.results), len(outageEvents(s)))
+		}
+		if !s.closed {
+			t.Errorf("%s sink wasn't closed", s.name)
+		}
+	}
+
+	health := f.health()
+	if len(health) != 3 {
+		t.Fatalf("fanout.health() returned %d sinks, want 3", len(health))
+	}
+	// the health events that follow the result fail too
+	if h := health[0]; h.healthy || h.failures < 2 || h.lastError != "connection refused" {
+		t.Errorf("failing sink health = %+v", h)
+	}
+	if h := health[2]; !h.healthy || h.failures != 0 || h.lastSuccess.IsZero() {
+		t.Errorf("healthy sink health = %+v", h)
+	}
+}
+
+// outageEvents leaves out the health events every result is followed by
+func outageEvents(f *fakeSink) []event {
+	var events []event
+	for _, ev := range f.events {
+		if ev.name == "speedtest_outage" {
+			events = append(events, ev)
+		}
+	}
+
+	return events
+}
+
+func Test_fanout_health(t *testing.T) {
+	failing := newFakeSink("failing", errors.New("connection refused"))
+	healthy := newFakeSink("healthy", nil)
+	f := newFanout(failing, healthy)
+
+	at := time.Unix(1525500000, 0)
+	f.writeResult(results{latency: floatPtr(9.5), timestamp: at})
+
+	// the result and then the health of both sinks, each written after the
+	// result reached that sink
+	for i := 0; i < 3; i++ {
+		waitReceived(t, healthy)
+	}
+	f.close()
+
+	got := map[string]map[string]interface{}{}
+	for _, ev := range healthy.events {
+		if ev.name != "speedtest_sink_health" || !ev.at.Equal(at) {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+		got[ev.tags["sink"]] = ev.fields
+	}
+	if h := got["failing"]; h["healthy"] != false || h["failures"] != 1 || h["last_error"] != "connection refused" {
+		t.Errorf("failing sink health event = %v", h)
+	}
+	if h := got["healthy"]; h["healthy"] != true || h["failures"] != 0 || h["last_success"] == nil {
+		t.Errorf("healthy sink health event = %v", h)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+const spoolExt = ".lp"
+
+// spoolStats counts what has passed through the spool since startup
+type spoolStats struct {
+	depth    int
+	bytes    int64
+	spooled  int
+	replayed int
+	dropped  int
+}
+
+// spoolingClient wraps a client, saving batches that fail to write to a spool
+// directory as line protocol and replaying them in order, with their original
+// timestamps, ahead of the next batch once writes succeed again
+type spoolingClient struct {
+	client.Client
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu    sync.Mutex
+	seq   int
+	stats spoolStats
+}
+
+func newSpoolingClient(c client.Client, dir string, maxSize int64, maxAge time.Duration) (*spoolingClient, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spoolingClient{
+		Client:  c,
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		log.Printf("found %d spooled batches in %s, replaying on the next write", len(files), dir)
+	}
+
+	return s, s.prune(time.Now())
+}
+
+func (s *spoolingClient) Write(bp client.BatchPoints) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// anything already spooled has to go first to keep points in order
+	err := s.replay()
+	if err == nil {
+		err = s.Client.Write(bp)
+	}
+	if err != nil && !retryable(err) {
+		// a batch influxDB rejects outright would only block the spool
+		log.Printf("not spooling a batch influxdb rejected: %v", err)
+	} else if err != nil {
+		spoolErr := s.save(bp)
+		if spoolErr != nil {
+			err = fmt.Errorf("%v, and couldn't spool the batch: %v", err, spoolErr)
+		} else {
+			err = fmt.Errorf("%v, batch spooled for replay", err)
+		}
+	}
+
+	pruneErr := s.prune(time.Now())
+	if pruneErr != nil {
+		log.Printf("error pruning spool: %v", pruneErr)
+	}
+
+	return err
+}
+
+// Stats returns the spool counters along with its current depth
+func (s *spoolingClient) Stats() spoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// replay writes the spooled batches oldest first, stopping at the first failure
+func (s *spoolingClient) replay() error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		bp, err := s.load(f)
+		if err != nil {
+			// an unreadable batch would block the spool forever
+			log.Printf("dropping unreadable spooled batch %s: %v", f, err)
+			s.stats.dropped++
+			s.remove(f)
+			continue
+		}
+
+		err = s.Client.Write(bp)
+		if err != nil && !retryable(err) {
+			log.Printf("dropping spooled batch %s rejected by influxdb: %v", f, err)
+			s.stats.dropped++
+			s.remove(f)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		s.stats.replayed++
+		s.remove(f)
+	}
+
+	if len(files) > 0 {
+		log.Printf("replayed spooled batches, %d replayed and %d dropped since startup", s.stats.replayed, s.stats.dropped)
+	}
+
+	return nil
+}
+
+// save writes the batch to the spool, with its write settings on a comment
+// line ahead of the points
+func (s *spoolingClient) save(bp client.BatchPoints) error {
+	params := url.Values{}
+	params.Set("db", bp.Database())
+	params.Set("rp", bp.RetentionPolicy())
+	params.Set("precision", bp.Precision())
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n", params.Encode())
+	for _, p := range bp.Points() {
+		b.WriteString(p.PrecisionString(bp.Precision()))
+		b.WriteByte('\n')
+	}
+
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq, spoolExt))
+	err := ioutil.WriteFile(name, b.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	s.stats.spooled++
+	return nil
+}
+
+func (s *spoolingClient) load(name string) (client.BatchPoints, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := url.ParseQuery(strings.TrimSpace(strings.TrimPrefix(header, "#")))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	points, err := models.ParsePointsWithPrecision(body, time.Now(), params.Get("precision"))
+	if err != nil {
+		return nil, err
+	}
+
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:        params.Get("db"),
+		RetentionPolicy: params.Get("rp"),
+		Precision:       params.Get("precision"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range points {
+		bp.AddPoint(client.NewPointFrom(p))
+	}
+
+	return bp, nil
+}
+
+// prune drops batches past the age limit, then the oldest batches until the
+// spool fits its size cap, and refreshes the depth stats
+func (s *spoolingClient) prune(now time.Time) error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	var sizes []int64
+	var total int64
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		sizes = append(sizes, info.Size())
+		total += info.Size()
+	}
+
+	depth := len(files)
+	for i, f := range files {
+		expired := s.maxAge > 0 && now.Sub(spooledAt(f)) > s.maxAge
+		oversize := s.maxSize > 0 && total > s.maxSize
+		if !expired && !oversize {
+			break
+		}
+
+		log.Printf("dropping spooled batch %s, expired: %t, spool over size cap: %t", f, expired, oversize)
+		s.remove(f)
+		s.stats.dropped++
+		total -= sizes[i]
+		depth--
+	}
+
+	s.stats.depth, s.stats.bytes = depth, total
+	return nil
+}
+
+func (s *spoolingClient) remove(name string) {
+	err := os.Remove(name)
+	if err != nil {
+		log.Printf("error removing spooled batch %s: %v", name, err)
+	}
+}
+
+// files lists the spooled batches, oldest first
+func (s *spoolingClient) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolExt))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// spooledAt reads the spool time back out of a batch file name
+func spooledAt(name string) time.Time {
+	base := filepath.Base(name)
+	i := strings.IndexByte(base, '-')
+	if i < 0 {
+		return time.Time{}
+	}
+
+	nanos, err := strconv.ParseInt(base[:i], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanos)
+}
+
+func (stats spoolStats) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"depth":    stats.depth,
+		"bytes":    stats.bytes,
+		"spooled":  stats.spooled,
+		"replayed": stats.replayed,
+		"dropped":  stats.dropped,
+	}
+}
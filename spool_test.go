@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func testBatch(t *testing.T, download float64, at time.Time) client.BatchPoints {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{Database: "speedtest", RetentionPolicy: "month", Precision: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := client.NewPoint("speedtest", map[string]string{"status": statusOK}, map[string]interface{}{"download": download}, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp.AddPoint(p)
+
+	return bp
+}
+
+func Test_spoolingClient_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakeInfluxClient{writeErr: errors.New("connection refused")}
+	s, err := newSpoolingClient(fake, dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("newSpoolingClient() error = %v", err)
+	}
+
+	first, second := time.Unix(1525500000, 0), time.Unix(1525501200, 0)
+	if err := s.Write(testBatch(t, 100, first)); err == nil {
+		t.Fatal("spoolingClient.Write() error = nil while influxdb is down")
+	}
+	if err := s.Write(testBatch(t, 90, second)); err == nil {
+		t.Fatal("spoolingClient.Write() error = nil while influxdb is down")
+	}
+	if got := s.Stats(); got.depth != 2 || got.spooled != 2 {
+		t.Fatalf("spoolingClient.Stats() = %+v, want depth and spooled of 2", got)
+	}
+
+	fake.writeErr, fake.writes = nil, nil
+	if err := s.Write(testBatch(t, 80, time.Unix(1525502400, 0))); err != nil {
+		t.Fatalf("spoolingClient.Write() error = %v", err)
+	}
+
+	if len(fake.writes) != 3 {
+		t.Fatalf("got %d writes, want the 2 spooled batches then the new one", len(fake.writes))
+	}
+	for i, want := range []time.Time{first, second} {
+		bp := fake.writes[i]
+		if bp.Database() != "speedtest" || bp.RetentionPolicy() != "month" || bp.Precision() != "s" {
+			t.Errorf("replayed batch %d settings = %s/%s/%s", i, bp.Database(), bp.RetentionPolicy(), bp.Precision())
+		}
+		if got := bp.Points()[0].Time(); !got.Equal(want) {
+			t.Errorf("replayed batch %d time = %v, want %v", i, got, want)
+		}
+	}
+	if got := s.Stats(); got.depth != 0 || got.replayed != 2 {
+		t.Errorf("spoolingClient.Stats() = %+v, want depth 0 and replayed 2", got)
+	}
+}
+
+func Test_spoolingClient_prune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakeInfluxClient{writeErr: errors.New("connection refused")}
+	s, err := newSpoolingClient(fake, dir, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("newSpoolingClient() error = %v", err)
+	}
+
+	s.Write(testBatch(t, 100, time.Unix(1525500000, 0)))
+	s.Write(testBatch(t, 90, time.Unix(1525501200, 0)))
+
+	s.maxSize = s.Stats().bytes - 1
+	if err := s.prune(time.Now()); err != nil {
+		t.Fatalf("spoolingClient.prune() error = %v", err)
+	}
+	if got := s.Stats(); got.depth != 1 || got.dropped != 1 {
+		t.Errorf("after size cap, spoolingClient.Stats() = %+v, want depth 1 and dropped 1", got)
+	}
+
+	if err := s.prune(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("spoolingClient.prune() error = %v", err)
+	}
+	if got := s.Stats(); got.depth != 0 || got.dropped != 2 {
+		t.Errorf("after age limit, spoolingClient.Stats() = %+v, want depth 0 and dropped 2", got)
+	}
+}
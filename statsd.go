@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+var statsdFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "statsd-addr",
+		Usage: "Send results as statsd gauges to this host:port over UDP, disabled when empty",
+	},
+	cli.StringFlag{
+		Name:  "statsd-prefix",
+		Value: "speedtest",
+		Usage: "The prefix of the statsd metric names",
+	},
+	cli.StringFlag{
+		Name:  "statsd-dialect",
+		Value: "statsd",
+		Usage: "statsd to put the server in the metric names, or dogstatsd to send it as tags",
+	},
+}
+
+// statsdNameTags are the tags put into plain statsd metric names, in order
+var statsdNameTags = []string{"server_country", "server_id"}
+
+// statsdSink sends every numeric field as a gauge and the test duration as a
+// timer, all in one packet per result
+type statsdSink struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+}
+
+func newStatsdSink(c *cli.Context) (sink, error) {
+	if c.String("statsd-addr") == "" {
+		return nil, nil
+	}
+
+	dialect := c.String("statsd-dialect")
+	if dialect != "statsd" && dialect != "dogstatsd" {
+		return nil, fmt.Errorf("unsupported statsd dialect %q", dialect)
+	}
+
+	conn, err := net.Dial("udp", c.String("statsd-addr"))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to statsd: %v", err)
+	}
+
+	return &statsdSink{
+		conn:      conn,
+		prefix:    c.String("statsd-prefix"),
+		dogstatsd: dialect == "dogstatsd",
+	}, nil
+}
+
+func (s *statsdSink) Name() string {
+	return "statsd"
+}
+
+func (s *statsdSink) WriteResult(res results) error {
+	_, err := s.conn.Write(s.encode(res))
+	return err
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
+
+func (s *statsdSink) encode(res results) []byte {
+	tags := resultTags(res)
+	fields := resultFields(res)
+
+	var names []string
+	for name, v := range fields {
+		if _, ok := v.(float64); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s:%v|g%s\n", s.metricName(name, tags), fields[name], s.tagSuffix(tags))
+	}
+	fmt.Fprintf(&b, "%s:%d|ms%s\n", s.metricName("duration", tags), res.duration.Nanoseconds()/1e6, s.tagSuffix(tags))
+
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+}
+
+// metricName puts the server into the name for plain statsd, which has no tags
+func (s *statsdSink) metricName(field string, tags map[string]string) string {
+	nodes := []string{s.prefix}
+	if !s.dogstatsd {
+		for _, tag := range statsdNameTags {
+			value := sanitizeGraphiteNode(tags[tag])
+			if value == "" {
+				value = "unknown"
+			}
+			nodes = append(nodes, value)
+		}
+	}
+
+	return strings.Join(append(nodes, field), ".")
+}
+
+var dogstatsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", " ")
+
+func (s *statsdSink) tagSuffix(tags map[string]string) string {
+	if !s.dogstatsd {
+		return ""
+	}
+
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, k+":"+dogstatsdTagEscaper.Replace(tags[k]))
+	}
+
+	return "|#" + strings.Join(parts, ",")
+}
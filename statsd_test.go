@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_statsdSink_encode(t *testing.T) {
+	res := results{
+		server:   testServer,
+		latency:  floatPtr(9.5),
+		download: floatPtr(100),
+		upload:   floatPtr(20),
+		duration: 42 * time.Second,
+	}
+
+	tests := []struct {
+		name      string
+		dogstatsd bool
+		res       results
+		want      string
+	}{
+		{
+			name: "statsd",
+			res:  res,
+			want: "speedtest.United_States.1234.download:100|g\n" +
+				"speedtest.United_States.1234.latency:9.5|g\n" +
+				"speedtest.United_States.1234.server_distance:12.5|g\n" +
+				"speedtest.United_States.1234.upload:20|g\n" +
+				"speedtest.United_States.1234.duration:42000|ms",
+		},
+		{
+			name:      "dogstatsd",
+			dogstatsd: true,
+			res:       results{latency: floatPtr(9.5), failedPhase: phaseDownload, duration: 3 * time.Second},
+			want: "speedtest.latency:9.5|g|#failed_phase:download,status:partial\n" +
+				"speedtest.duration:3000|ms|#failed_phase:download,status:partial",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &statsdSink{prefix: "speedtest", dogstatsd: tt.dogstatsd}
+			if got := string(s.encode(tt.res)); got != tt.want {
+				t.Errorf("statsdSink.encode() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	speedtesthttp "github.com/kylegrantlucas/speedtest/http"
+	"github.com/urfave/cli"
+)
+
+var webhookFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "webhook-url",
+		Usage: "Send each result to this URL, disabled when empty",
+	},
+	cli.StringFlag{
+		Name:  "webhook-method",
+		Value: "POST",
+		Usage: "The webhook request method, POST or PUT",
+	},
+	cli.StringFlag{
+		Name:  "webhook-template",
+		Value: "{{json .Result}}",
+		Usage: "The text/template for the request body",
+	},
+	cli.StringFlag{
+		Name:  "webhook-template-file",
+		Usage: "Read the body template from this file instead of --webhook-template",
+	},
+	cli.StringFlag{
+		Name:  "webhook-content-type",
+		Value: "application/json",
+		Usage: "The Content-Type of the rendered body",
+	},
+	cli.StringSliceFlag{
+		Name:  "webhook-header",
+		Usage: "An extra request header as \"Name: value\", may be repeated",
+	},
+	cli.StringFlag{
+		Name:  "webhook-username",
+		Usage: "The username for webhook basic auth",
+	},
+	cli.StringFlag{
+		Name:   "webhook-password",
+		Usage:  "The password for webhook basic auth",
+		EnvVar: "WEBHOOK_PASSWORD",
+	},
+	cli.StringFlag{
+		Name:   "webhook-bearer-token",
+		Usage:  "The bearer token for webhook auth, used instead of basic auth",
+		EnvVar: "WEBHOOK_BEARER_TOKEN",
+	},
+	cli.StringFlag{
+		Name:  "webhook-ca-file",
+		Usage: "A PEM file of CAs to verify the webhook server with, instead of the system pool",
+	},
+	cli.BoolFlag{
+		Name:  "webhook-insecure-skip-verify",
+		Usage: "Don't verify the webhook server's certificate",
+	},
+	cli.IntFlag{
+		Name:  "webhook-retries",
+		Value: 3,
+		Usage: "The number of times to retry a failed webhook request, 0 disables retrying",
+	},
+	cli.IntFlag{
+		Name:  "webhook-retry-initial",
+		Value: 1,
+		Usage: "The amount of time in seconds to wait before the first retry, doubled each retry",
+	},
+}
+
+// webhookData is what the body template is executed with
+type webhookData struct {
+	Timestamp   time.Time
+	Duration    time.Duration
+	Status      string
+	FailedPhase string
+	Error       string
+	Latency     *float64
+	Download    *float64
+	Upload      *float64
+	Server      speedtesthttp.Server
+	Client      speedtesthttp.Config
+
+	// the influxDB tags and fields, and the flat document published over MQTT
+	Tags   map[string]string
+	Fields map[string]interface{}
+	Result map[string]interface{}
+}
+
+func newWebhookData(res results) webhookData {
+	data := webhookData{
+		Timestamp:   res.timestamp,
+		Duration:    res.duration,
+		Status:      res.status(),
+		FailedPhase: res.failedPhase,
+		Latency:     res.latency,
+		Download:    res.download,
+		Upload:      res.upload,
+		Server:      res.server,
+		Client:      res.client,
+		Tags:        resultTags(res),
+		Fields:      resultFields(res),
+		Result:      resultJSON(res),
+	}
+	if res.err != nil {
+		data.Error = res.err.Error()
+	}
+
+	return data
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// webhookSink renders each result with a template and sends it to a URL, for
+// the APIs and flow tools nothing else here speaks to
+type webhookSink struct {
+	url          string
+	method       string
+	body         *template.Template
+	contentType  string
+	headers      http.Header
+	username     string
+	password     string
+	bearerToken  string
+	maxAttempts  int
+	retryInitial time.Duration
+	sleep        func(time.Duration)
+	httpClient   *http.Client
+}
+
+func newWebhookSink(c *cli.Context) (sink, error) {
+	if c.String("webhook-url") == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(c.String("webhook-url"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported webhook url scheme %q", u.Scheme)
+	}
+
+	method := strings.ToUpper(c.String("webhook-method"))
+	if method != "POST" && method != "PUT" {
+		return nil, fmt.Errorf("unsupported webhook method %q", c.String("webhook-method"))
+	}
+
+	text := c.String("webhook-template")
+	if c.String("webhook-template-file") != "" {
+		b, err := ioutil.ReadFile(c.String("webhook-template-file"))
+		if err != nil {
+			return nil, fmt.Errorf("error reading webhook template: %v", err)
+		}
+		text = string(b)
+	}
+
+	body, err := template.New("webhook").Funcs(webhookFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %v", err)
+	}
+
+	headers := http.Header{}
+	for _, h := range c.StringSlice("webhook-header") {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid webhook header %q, want \"Name: value\"", h)
+		}
+		headers.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	tlsConfig, err := clientTLSConfig("", c.String("webhook-ca-file"), c.Bool("webhook-insecure-skip-verify"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhookSink{
+		url:          u.String(),
+		method:       method,
+		body:         body,
+		contentType:  c.String("webhook-content-type"),
+		headers:      headers,
+		username:     c.String("webhook-username"),
+		password:     c.String("webhook-password"),
+		bearerToken:  c.String("webhook-bearer-token"),
+		maxAttempts:  c.Int("webhook-retries") + 1,
+		retryInitial: time.Duration(c.Int("webhook-retry-initial")) * time.Second,
+		sleep:        time.Sleep,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}, nil
+}
+
+func (s *webhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *webhookSink) WriteResult(res results) error {
+	var body bytes.Buffer
+	err := s.body.Execute(&body, newWebhookData(res))
+	if err != nil {
+		return fmt.Errorf("error rendering webhook template: %v", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = s.send(body.Bytes())
+		if err == nil || !webhookRetryable(err) || attempt >= s.maxAttempts {
+			return err
+		}
+
+		delay := backoff(s.retryInitial, attempt)
+		log.Printf("error sending webhook, retry %d of %d in %s: %v", attempt, s.maxAttempts-1, delay, err)
+		s.sleep(delay)
+	}
+}
+
+// webhookStatusError is a non-2xx webhook response
+type webhookStatusError struct {
+	statusCode int
+	status     string
+	message    []byte
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook returned %s: %s", e.status, e.message)
+}
+
+// webhookRetryable reports whether a failed request is worth trying again,
+// client errors other than timeouts and rate limits aren't
+func webhookRetryable(err error) bool {
+	switch e := err.(type) {
+	case *webhookStatusError:
+		return retryableStatus(e.statusCode)
+	case net.Error:
+		return true
+	}
+
+	return false
+}
+
+func (s *webhookSink) send(body []byte) error {
+	req, err := http.NewRequest(s.method, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range s.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", s.contentType)
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", "speedtest-to-influxdb")
+	}
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearerToken)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &webhookStatusError{statusCode: resp.StatusCode, status: resp.Status, message: bytes.TrimSpace(msg)}
+	}
+
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func Test_webhookSink_WriteResult(t *testing.T) {
+	res := results{
+		server:    testServer,
+		client:    testClient,
+		latency:   floatPtr(9.5),
+		download:  floatPtr(94.2),
+		upload:    floatPtr(11.7),
+		timestamp: time.Unix(1500000000, 0),
+	}
+
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int
+		wantErr      bool
+	}{
+		{"accepted", []int{200}, 1, false},
+		{"retried until accepted", []int{503, 429, 204}, 3, false},
+		{"gives up after the retries", []int{503, 503, 503, 503}, 3, true},
+		{"client error isn't retried", []int{400, 200}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if want := "ok Example ISP 203.0.113.7 94.20"; string(body) != want {
+					t.Errorf("body = %q, want %q", body, want)
+				}
+				if user, pass, _ := r.BasicAuth(); r.Method != "PUT" || user != "user" || pass != "secret" {
+					t.Errorf("request = %s as %s:%s, want PUT as user:secret", r.Method, user, pass)
+				}
+				if got := r.Header.Get("X-Source"); got != "probe" {
+					t.Errorf("X-Source = %q, want %q", got, "probe")
+				}
+
+				w.WriteHeader(tt.statuses[requests])
+				requests++
+			}))
+			defer srv.Close()
+
+			s := &webhookSink{
+				url:          srv.URL,
+				method:       "PUT",
+				body:         template.Must(template.New("webhook").Funcs(webhookFuncs).Parse(`{{.Status}} {{.Server.Sponsor}} {{.Client.IP}} {{printf "%.2f" .Fields.download}}`)),
+				contentType:  "text/plain",
+				headers:      http.Header{"X-Source": {"probe"}},
+				username:     "user",
+				password:     "secret",
+				maxAttempts:  3,
+				retryInitial: time.Second,
+				sleep:        func(time.Duration) {},
+				httpClient:   srv.Client(),
+			}
+
+			err := s.WriteResult(res)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("WriteResult() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("WriteResult() sent %d requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}